@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+// AccessConfig is access control settings of HTTP API
+type AccessConfig struct {
+	// Mode is 'allowlist' - only clients from Allow or with valid API key are allowed,
+	// 'denylist' - all clients except Deny are allowed, or 'off' - access is not checked
+	Mode string `json:"mode"`
+	// Allow and Deny are IPs or CIDR ranges, like 10.0.0.0/8. Deny is checked in both modes
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+	// TrustedProxies are IPs or CIDR ranges of reverse proxies. Client IP is taken from X-Forwarded-For,
+	// if request came from trusted proxy
+	TrustedProxies []string `json:"trusted_proxies"`
+	// APIKeys are client names by API key. Key is passed in X-API-Key header or api_key query argument
+	APIKeys map[string]string `json:"api_keys"`
+}
+
+// DefaultAccessConfig allows only local clients
+var DefaultAccessConfig = AccessConfig{
+	Mode:  "allowlist",
+	Allow: []string{"127.0.0.0/8", "::1"},
+}
+
+// AccessControl checks, if client is allowed to use HTTP API
+type AccessControl struct {
+	mode    string
+	allow   []*net.IPNet
+	deny    []*net.IPNet
+	trusted []*net.IPNet
+	apiKeys map[string]string
+}
+
+var access *AccessControl
+
+func parseIPNets(values []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(values))
+	for _, v := range values {
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid IP %s", v)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid CIDR %s", v)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func NewAccessControl(cfg AccessConfig) (*AccessControl, error) {
+	switch cfg.Mode {
+	case "allowlist", "denylist", "off":
+	default:
+		return nil, fmt.Errorf("Unknown access mode '%s'. Valid values are: 'allowlist', 'denylist' or 'off'", cfg.Mode)
+	}
+
+	a := &AccessControl{mode: cfg.Mode, apiKeys: cfg.APIKeys}
+	var err error
+	if a.allow, err = parseIPNets(cfg.Allow); err != nil {
+		return nil, err
+	}
+	if a.deny, err = parseIPNets(cfg.Deny); err != nil {
+		return nil, err
+	}
+	if a.trusted, err = parseIPNets(cfg.TrustedProxies); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// loadAccessControl reads access config from JSON file. DefaultAccessConfig is used, if path is empty
+func loadAccessControl(path string) (*AccessControl, error) {
+	cfg := DefaultAccessConfig
+	if len(path) != 0 {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		cfg = AccessConfig{}
+		if err = json.Unmarshal(data, &cfg); err != nil {
+			return nil, fmt.Errorf("Error parse access config %s: %s", path, err.Error())
+		}
+	}
+	return NewAccessControl(cfg)
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns IP of client. If request came from trusted proxy, the last X-Forwarded-For address,
+// which is not trusted proxy, is used
+func (a *AccessControl) ClientIP(ctx *fasthttp.RequestCtx) net.IP {
+	ip := ctx.RemoteIP()
+	if !containsIP(a.trusted, ip) {
+		return ip
+	}
+
+	forwarded := strings.Split(string(ctx.Request.Header.Peek("X-Forwarded-For")), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		fip := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if fip == nil {
+			break
+		}
+		ip = fip
+		if !containsIP(a.trusted, ip) {
+			break
+		}
+	}
+	return ip
+}
+
+// redactedURI returns request URI with masked api_key argument, so API keys are not written to logs
+func redactedURI(ctx *fasthttp.RequestCtx) string {
+	if !ctx.QueryArgs().Has("api_key") {
+		return string(ctx.RequestURI())
+	}
+	uri := &fasthttp.URI{}
+	ctx.URI().CopyTo(uri)
+	uri.QueryArgs().Set("api_key", "REDACTED")
+	return string(uri.RequestURI())
+}
+
+// Check returns client name, if client is identified by API key, or error, if client is not allowed
+func (a *AccessControl) Check(ctx *fasthttp.RequestCtx, ip net.IP) (string, error) {
+	if a.mode == "off" {
+		return "", nil
+	}
+
+	if containsIP(a.deny, ip) {
+		return "", newAPIError(CodeForbidden, "Access denied for %s", ip)
+	}
+
+	key := string(ctx.Request.Header.Peek("X-API-Key"))
+	if len(key) == 0 {
+		key = string(ctx.QueryArgs().Peek("api_key"))
+	}
+	if len(key) != 0 {
+		client, ok := a.apiKeys[key]
+		if !ok {
+			return "", newAPIError(CodeForbidden, "Invalid API key")
+		}
+		return client, nil
+	}
+
+	if a.mode == "allowlist" && !containsIP(a.allow, ip) {
+		return "", newAPIError(CodeForbidden, "Access denied for %s", ip)
+	}
+	return "", nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"expvar"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttpadaptor"
+)
+
+// FTConfigResponce is response of admin FTConfig handlers. Previous is set only on config update
+type FTConfigResponce struct {
+	Success  bool      `json:"success"`
+	Config   FTConfig  `json:"config"`
+	Previous *FTConfig `json:"previous,omitempty"`
+}
+
+func secureEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// adminAuthorized checks Authorization header against admintoken bearer token or adminauth user:password
+func adminAuthorized(ctx *fasthttp.RequestCtx) bool {
+	auth := string(ctx.Request.Header.Peek("Authorization"))
+
+	if len(*adminToken) != 0 && strings.HasPrefix(auth, "Bearer ") {
+		return secureEqual(strings.TrimPrefix(auth, "Bearer "), *adminToken)
+	}
+
+	if len(*adminBasicAuth) != 0 && strings.HasPrefix(auth, "Basic ") {
+		creds, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(auth, "Basic "))
+		return err == nil && secureEqual(string(creds), *adminBasicAuth)
+	}
+	return false
+}
+
+// AdminWrapper rejects requests without valid admin credentials
+func AdminWrapper(handler func(ctx *fasthttp.RequestCtx)) func(ctx *fasthttp.RequestCtx) {
+	return func(ctx *fasthttp.RequestCtx) {
+		if !adminAuthorized(ctx) {
+			if len(*adminBasicAuth) != 0 {
+				ctx.Response.Header.Set("WWW-Authenticate", `Basic realm="habr-search admin"`)
+			}
+			respError(ctx, newAPIError(CodeUnauthorized, "Unauthorized"))
+			return
+		}
+		handler(ctx)
+	}
+}
+
+func GetFTConfigHandler(ctx *fasthttp.RequestCtx) {
+	ns := ctx.UserValue("ns").(string)
+
+	cfg, err := repo.GetFTConfig(ns)
+	if err != nil {
+		respError(ctx, err)
+		return
+	}
+	respJSON(ctx, FTConfigResponce{Success: true, Config: cfg})
+}
+
+// SetFTConfigHandler applies FTConfig from request body. Fields, missing in body, are kept unchanged
+func SetFTConfigHandler(ctx *fasthttp.RequestCtx) {
+	ns := ctx.UserValue("ns").(string)
+
+	newCfg, err := repo.GetFTConfig(ns)
+	if err != nil {
+		respError(ctx, err)
+		return
+	}
+	if err = json.Unmarshal(ctx.PostBody(), &newCfg); err != nil {
+		respError(ctx, InvalidArgumentError("Invalid config: %s", err.Error()))
+		return
+	}
+	if err = newCfg.Validate(ns); err != nil {
+		respError(ctx, InvalidArgumentError("%s", err.Error()))
+		return
+	}
+
+	prevCfg, err := repo.SetFTConfig(ns, newCfg)
+	if err != nil {
+		respError(ctx, err)
+		return
+	}
+	ctxLogger(ctx).Infof("FTConfig of %s is changed from %+v to %+v", ns, prevCfg, newCfg)
+	respJSON(ctx, FTConfigResponce{Success: true, Config: newCfg, Previous: &prevCfg})
+}
+
+// adminRoutes returns /admin routes, if admin credentials are configured
+func adminRoutes() []httpRoute {
+	if len(*adminToken) == 0 && len(*adminBasicAuth) == 0 {
+		httpLog.Infof("Admin API is disabled, set HABR_ADMINTOKEN or HABR_ADMINAUTH to enable it")
+		return nil
+	}
+	return []httpRoute{
+		{method: "GET", path: "/admin/ftconfig/:ns", handler: AdminWrapper(GetFTConfigHandler)},
+		{method: "POST", path: "/admin/ftconfig/:ns", handler: AdminWrapper(SetFTConfigHandler)},
+		// expvar publishes command line and runtime internals, so it is available to admins only
+		{method: "GET", path: "/debug/vars", handler: AdminWrapper(fasthttpadaptor.NewFastHTTPHandler(expvar.Handler())), internal: true},
+	}
+}
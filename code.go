@@ -0,0 +1,115 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// maxIdentParts limits number of parts of identifier, which are combined to tokens
+const maxIdentParts = 8
+
+// identRe matches identifiers and chains of them, joined by dots, e.g. os.Getenv or parse_http_request
+var identRe = regexp.MustCompile(`[\pL_][\pL\pN_]*(\.[\pL_][\pL\pN_]*)*`)
+
+// splitIdent splits identifier by dots, underscores and camelCase boundaries: parseHTTPRequest is
+// split to parse, HTTP and Request
+func splitIdent(ident string) []string {
+	parts := make([]string, 0)
+	for _, word := range strings.FieldsFunc(ident, func(r rune) bool { return r == '.' || r == '_' }) {
+		runes := []rune(word)
+		start := 0
+		for i := 1; i < len(runes); i++ {
+			prev, cur := runes[i-1], runes[i]
+			lowerToUpper := !unicode.IsUpper(prev) && unicode.IsUpper(cur)
+			acronymEnd := unicode.IsUpper(prev) && unicode.IsUpper(cur) && i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if lowerToUpper || acronymEnd {
+				parts = append(parts, string(runes[start:i]))
+				start = i
+			}
+		}
+		parts = append(parts, string(runes[start:]))
+	}
+	return parts
+}
+
+// identTokens returns lowercased parts of identifier and all joined sequences of adjacent parts,
+// so parseHTTPRequest is found by parse, request, httprequest and parsehttprequest
+func identTokens(ident string) []string {
+	parts := splitIdent(ident)
+	if len(parts) > maxIdentParts {
+		parts = parts[:maxIdentParts]
+	}
+	tokens := make([]string, 0, len(parts)*(len(parts)+1)/2)
+	seen := make(map[string]bool)
+	for i := range parts {
+		for j := i + 1; j <= len(parts); j++ {
+			token := strings.ToLower(strings.Join(parts[i:j], ""))
+			if len(token) > 1 && !seen[token] {
+				seen[token] = true
+				tokens = append(tokens, token)
+			}
+		}
+	}
+	return tokens
+}
+
+// codeTokens returns tokens of all identifiers in code, space separated. It is indexed instead of code itself
+func codeTokens(code string) string {
+	tokens := make([]string, 0)
+	for _, ident := range identRe.FindAllString(code, -1) {
+		tokens = append(tokens, identTokens(ident)...)
+	}
+	return strings.Join(tokens, " ")
+}
+
+// codeQueryTokens returns one token for each identifier of query: its parts, joined and lowercased
+func codeQueryTokens(query string) []string {
+	tokens := make([]string, 0)
+	for _, ident := range identRe.FindAllString(query, -1) {
+		if token := strings.ToLower(strings.Join(splitIdent(ident), "")); len(token) > 1 {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
+}
+
+// codeDSL returns reindexer full text query, which requires all tokens of query
+func codeDSL(query string) string {
+	tokens := codeQueryTokens(query)
+	for i := range tokens {
+		tokens[i] = "+" + tokens[i]
+	}
+	return strings.Join(tokens, " ")
+}
+
+// codeLang returns language of code block from class of <code> or <pre> tag, e.g. <code class="go">
+func codeLang(pre *goquery.Selection) string {
+	for _, s := range []*goquery.Selection{pre.Find("code").First(), pre} {
+		if class, ok := s.Attr("class"); ok {
+			if classes := strings.Fields(class); len(classes) != 0 {
+				return strings.ToLower(classes[0])
+			}
+		}
+	}
+	return ""
+}
+
+// parseCodeBlocks returns <pre> blocks of post text
+func parseCodeBlocks(postID int, s *goquery.Selection) (blocks []*HabrCode) {
+	s.Find("pre").Each(func(i int, pre *goquery.Selection) {
+		code := strings.TrimRight(pre.Text(), "\n")
+		if len(strings.TrimSpace(code)) == 0 {
+			return
+		}
+		blocks = append(blocks, &HabrCode{
+			ID:     postID*1000 + len(blocks),
+			PostID: postID,
+			Lang:   codeLang(pre),
+			Code:   code,
+		})
+	})
+	return blocks
+}
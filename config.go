@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// configEnvPrefix is prefix of environment variables, which override config values, e.g. HABR_HTTPADDR
+const configEnvPrefix = "HABR_"
+
+// secretFlags are masked by 'config print' command. They can't be passed in command line, which is visible
+// to other processes, and are read only from environment variables or config file
+var secretFlags = map[string]bool{"admintoken": true, "adminauth": true}
+
+var configPath = flag.String("config", "", "Path to JSON config file. Keys are flag names, e.g. {\"httpaddr\": \":8881\"}")
+
+func configEnvName(flagName string) string {
+	return configEnvPrefix + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+func configValueString(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	default:
+		return "", fmt.Errorf("unsupported value type %T", v)
+	}
+}
+
+// loadConfig applies settings from config file and environment variables to flags, which were not set
+// in command line. Priority is: command line, environment, config file, flag defaults
+func loadConfig() error {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for name := range secretFlags {
+		if set[name] {
+			return fmt.Errorf("Setting '%s' can't be passed in command line, use %s environment variable or config file", name, configEnvName(name))
+		}
+	}
+
+	if env, ok := os.LookupEnv(configEnvName("config")); ok && !set["config"] {
+		*configPath = env
+	}
+
+	if len(*configPath) != 0 {
+		data, err := ioutil.ReadFile(*configPath)
+		if err != nil {
+			return err
+		}
+		values := make(map[string]interface{})
+		if err = json.Unmarshal(data, &values); err != nil {
+			return fmt.Errorf("Error parse config %s: %s", *configPath, err.Error())
+		}
+		for name, value := range values {
+			if flag.Lookup(name) == nil || name == "config" {
+				return fmt.Errorf("Unknown setting '%s' in config %s", name, *configPath)
+			}
+			if set[name] {
+				continue
+			}
+			str, err := configValueString(value)
+			if err == nil {
+				err = flag.Set(name, str)
+			}
+			if err != nil {
+				return fmt.Errorf("Invalid value of '%s' in config %s: %s", name, *configPath, err.Error())
+			}
+		}
+	}
+
+	var envErr error
+	flag.VisitAll(func(f *flag.Flag) {
+		env, ok := os.LookupEnv(configEnvName(f.Name))
+		if !ok || set[f.Name] || f.Name == "config" || envErr != nil {
+			return
+		}
+		if err := flag.Set(f.Name, env); err != nil {
+			envErr = fmt.Errorf("Invalid value of %s: %s", configEnvName(f.Name), err.Error())
+		}
+	})
+	return envErr
+}
+
+// validateConfig checks effective settings
+func validateConfig() error {
+	switch {
+	case !strings.Contains(*httpAddr, ":"):
+		return fmt.Errorf("Invalid httpaddr '%s', must be [host]:port", *httpAddr)
+	case *importStartID < 1 || *importFinishID <= *importStartID:
+		return fmt.Errorf("Invalid import range %d-%d: startid must be positive and less than finishid", *importStartID, *importFinishID)
+	case len(*dumpPostsPath) == 0:
+		return fmt.Errorf("dumppath must be set")
+	case len(*webRootPath) == 0:
+		return fmt.Errorf("webrootpath must be set")
+	case *syncTimeout < 1:
+		return fmt.Errorf("synctimeout must be at least 1 minute, got %d", *syncTimeout)
+	case *storageType != "reindexer" && *storageType != "memory":
+		return fmt.Errorf("Unknown storage %s. Valid values are: 'reindexer' or 'memory'", *storageType)
+	case *syncMode != "discover" && *syncMode != "range":
+		return fmt.Errorf("Invalid syncmode %s. Valid values are: 'discover' or 'range'", *syncMode)
+	case *discoverMaxMisses < 1:
+		return fmt.Errorf("discovermisses must be positive, got %d", *discoverMaxMisses)
+	case *refreshDays < 0:
+		return fmt.Errorf("refreshdays must not be negative, got %d", *refreshDays)
+	case *numParallelImports < 1:
+		return fmt.Errorf("parallelimports must be positive, got %d", *numParallelImports)
+	case *crawlRPS < 0:
+		return fmt.Errorf("rps must not be negative, got %g", *crawlRPS)
+	case *crawlMaxRetries < 0:
+		return fmt.Errorf("maxretries must not be negative, got %d", *crawlMaxRetries)
+	case *shutdownTimeout < 1:
+		return fmt.Errorf("shutdowntimeout must be positive, got %d", *shutdownTimeout)
+	case len(*adminBasicAuth) != 0 && !strings.Contains(*adminBasicAuth, ":"):
+		return fmt.Errorf("adminauth must be in user:password format")
+	}
+	return nil
+}
+
+// printConfig prints effective settings in config file format
+func printConfig() {
+	values := make(map[string]interface{})
+	flag.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" {
+			return
+		}
+		value := f.Value.(flag.Getter).Get()
+		if secretFlags[f.Name] && len(f.Value.String()) != 0 {
+			value = "***"
+		}
+		values[f.Name] = value
+	})
+	data, _ := json.MarshalIndent(values, "", "  ")
+	fmt.Println(string(data))
+}
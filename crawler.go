@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var crawlLog = logger.With(LogFields{"component": "crawler"})
+
+// maxBackoff limits delay between retries of failed request
+const maxBackoff = time.Minute
+
+// ErrDisallowedByRobots is returned for URLs, which are disallowed by site's robots.txt
+var ErrDisallowedByRobots = fmt.Errorf("URL is disallowed by robots.txt")
+
+// Crawler makes polite requests to sites: it limits request rate, retries 429 and 5xx
+// responses with exponential backoff, sends User-Agent and honors robots.txt
+type Crawler struct {
+	client      *http.Client
+	userAgent   string
+	maxRetries  int
+	checkRobots bool
+	limiter     *rateLimiter
+
+	lock   sync.Mutex
+	robots map[string]*robotsEntry
+}
+
+// robotsEntry is robots.txt rules of host. Ready is closed, when rules are fetched
+type robotsEntry struct {
+	ready chan struct{}
+	rules *robotsRules
+}
+
+func NewCrawler(userAgent string, rps float64, maxRetries int, checkRobots bool) *Crawler {
+	return &Crawler{
+		client:      &http.Client{Timeout: 30 * time.Second},
+		userAgent:   userAgent,
+		maxRetries:  maxRetries,
+		checkRobots: checkRobots,
+		limiter:     newRateLimiter(rps),
+		robots:      make(map[string]*robotsEntry),
+	}
+}
+
+var crawler = NewCrawler("habr-search", 0, 0, false)
+
+type rateLimiter struct {
+	lock     sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func newRateLimiter(rps float64) *rateLimiter {
+	l := &rateLimiter{}
+	if rps > 0 {
+		l.interval = time.Duration(float64(time.Second) / rps)
+	}
+	return l
+}
+
+// setMinInterval slows down limiter, if interval is greater than current one
+func (l *rateLimiter) setMinInterval(interval time.Duration) {
+	l.lock.Lock()
+	if interval > l.interval {
+		l.interval = interval
+	}
+	l.lock.Unlock()
+}
+
+// Wait blocks until next request is allowed, or context is cancelled
+func (l *rateLimiter) Wait(ctx context.Context) error {
+	l.lock.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	wait := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	l.lock.Unlock()
+
+	return sleepContext(ctx, wait)
+}
+
+// sleepContext pauses for duration d, or until context is cancelled
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type robotsRule struct {
+	allow   bool
+	pattern *regexp.Regexp
+	length  int
+}
+
+type robotsRules struct {
+	rules      []robotsRule
+	crawlDelay time.Duration
+}
+
+// Allowed checks path by the longest matching rule, as Google and Yandex do
+func (r *robotsRules) Allowed(path string) bool {
+	allowed, matchLen := true, -1
+	for _, rule := range r.rules {
+		if rule.length > matchLen && rule.pattern.MatchString(path) {
+			allowed, matchLen = rule.allow, rule.length
+		}
+	}
+	return allowed
+}
+
+func robotsPattern(path string) *regexp.Regexp {
+	anchored := strings.HasSuffix(path, "$")
+	path = strings.TrimSuffix(path, "$")
+	expr := "^" + strings.Replace(regexp.QuoteMeta(path), `\*`, ".*", -1)
+	if anchored {
+		expr += "$"
+	}
+	return regexp.MustCompile(expr)
+}
+
+// parseRobots parses robots.txt and returns rules of the group with the longest agent, matching userAgent,
+// or of the "*" group
+func parseRobots(r io.Reader, userAgent string) *robotsRules {
+	token := strings.ToLower(strings.SplitN(userAgent, "/", 2)[0])
+	groups := make(map[string]*robotsRules)
+	var current []*robotsRules
+	inAgents := false
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if idx := strings.Index(line, "#"); idx >= 0 {
+			line = line[:idx]
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(parts[0]))
+		value := strings.TrimSpace(parts[1])
+
+		switch key {
+		case "user-agent":
+			if !inAgents {
+				current = current[:0]
+			}
+			inAgents = true
+			agent := strings.ToLower(value)
+			if _, ok := groups[agent]; !ok {
+				groups[agent] = &robotsRules{}
+			}
+			current = append(current, groups[agent])
+		case "allow", "disallow":
+			inAgents = false
+			if len(value) == 0 {
+				continue
+			}
+			for _, g := range current {
+				g.rules = append(g.rules, robotsRule{allow: key == "allow", pattern: robotsPattern(value), length: len(value)})
+			}
+		case "crawl-delay":
+			inAgents = false
+			if delay, err := strconv.ParseFloat(value, 64); err == nil {
+				for _, g := range current {
+					g.crawlDelay = time.Duration(delay * float64(time.Second))
+				}
+			}
+		default:
+			inAgents = false
+		}
+	}
+
+	// The most specific group is used: the longest agent, which is contained in token
+	var matched *robotsRules
+	matchLen := 0
+	for agent, rules := range groups {
+		if agent != "*" && len(agent) > matchLen && strings.Contains(token, agent) {
+			matched, matchLen = rules, len(agent)
+		}
+	}
+	if matched != nil {
+		return matched
+	}
+	if rules, ok := groups["*"]; ok {
+		return rules
+	}
+	return &robotsRules{}
+}
+
+// robotsFor returns robots.txt rules of host of URL. Rules are fetched once without holding lock,
+// so requests to other hosts are not blocked, and concurrent requests to the same host wait for the fetch
+func (c *Crawler) robotsFor(ctx context.Context, u *url.URL) *robotsRules {
+	host := u.Scheme + "://" + u.Host
+
+	c.lock.Lock()
+	entry, ok := c.robots[host]
+	if !ok {
+		entry = &robotsEntry{ready: make(chan struct{})}
+		c.robots[host] = entry
+	}
+	c.lock.Unlock()
+
+	if ok {
+		select {
+		case <-entry.ready:
+			return entry.rules
+		case <-ctx.Done():
+			// Request is cancelled anyway
+			return &robotsRules{}
+		}
+	}
+
+	var known bool
+	entry.rules, known = c.fetchRobots(ctx, host)
+	if !known || ctx.Err() != nil {
+		// Rules are not known, fetch them again on the next request
+		c.lock.Lock()
+		delete(c.robots, host)
+		c.lock.Unlock()
+	}
+	close(entry.ready)
+	return entry.rules
+}
+
+// disallowAllRobots returns rules, which disallow all paths
+func disallowAllRobots() *robotsRules {
+	return &robotsRules{rules: []robotsRule{{allow: false, pattern: robotsPattern("/"), length: 1}}}
+}
+
+// fetchRobots returns robots.txt rules of host, and false if rules are not known. Missing robots.txt (4xx status)
+// allows all paths. Network errors and 5xx statuses disallow all paths, until robots.txt is fetched successfully
+func (c *Crawler) fetchRobots(ctx context.Context, host string) (*robotsRules, bool) {
+	resp, err := c.do(ctx, host+"/robots.txt")
+	if err != nil {
+		crawlLog.Warnf("Can't get %s/robots.txt: %s, all paths are disallowed", host, err.Error())
+		return disallowAllRobots(), false
+	}
+	defer resp.Body.Close()
+
+	var rules *robotsRules
+	switch {
+	case resp.StatusCode == 200:
+		rules = parseRobots(resp.Body, c.userAgent)
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		rules = &robotsRules{}
+	default:
+		crawlLog.Warnf("Can't get %s/robots.txt: got %d status, all paths are disallowed", host, resp.StatusCode)
+		return disallowAllRobots(), false
+	}
+	if rules.crawlDelay > 0 {
+		crawlLog.Infof("Using crawl delay %v from %s/robots.txt", rules.crawlDelay, host)
+		c.limiter.setMinInterval(rules.crawlDelay)
+	}
+	return rules, true
+}
+
+func (c *Crawler) do(ctx context.Context, rawurl string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", rawurl, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", c.userAgent)
+
+	if err = c.limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+	return c.client.Do(req.WithContext(ctx))
+}
+
+// retryAfter returns delay from Retry-After header in seconds or HTTP-date form, or backoff, if header is not set.
+// Delay is limited by maxBackoff, so misconfigured server can't stop crawling for a long time
+func retryAfter(resp *http.Response, backoff time.Duration) time.Duration {
+	value := resp.Header.Get("Retry-After")
+	wait := backoff
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		wait = time.Duration(seconds) * time.Second
+	} else if t, err := http.ParseTime(value); err == nil && time.Until(t) > 0 {
+		wait = time.Until(t)
+	}
+	if wait > maxBackoff {
+		wait = maxBackoff
+	}
+	return wait
+}
+
+// Get makes GET request. Network errors, 429 and 5xx responses are retried with exponential backoff,
+// until context is cancelled. Caller must close body of returned response
+func (c *Crawler) Get(ctx context.Context, rawurl string) (*http.Response, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.checkRobots && !c.robotsFor(ctx, u).Allowed(u.RequestURI()) {
+		return nil, ErrDisallowedByRobots
+	}
+
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		resp, err := c.do(ctx, rawurl)
+
+		retry, wait := false, backoff
+		switch {
+		case ctx.Err() != nil:
+			if resp != nil {
+				resp.Body.Close()
+			}
+			return nil, ctx.Err()
+		case err != nil:
+			retry = true
+		case resp.StatusCode == 429 || resp.StatusCode >= 500:
+			retry = true
+			wait = retryAfter(resp, backoff)
+		}
+
+		if !retry || attempt >= c.maxRetries {
+			return resp, err
+		}
+
+		if resp != nil {
+			resp.Body.Close()
+			crawlLog.Warnf("%s - Got %d status, retry in %v", rawurl, resp.StatusCode, wait)
+		} else {
+			crawlLog.Warnf("%s - %s, retry in %v", rawurl, err.Error(), wait)
+		}
+		if err = sleepContext(ctx, wait); err != nil {
+			return nil, err
+		}
+
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
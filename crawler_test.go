@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		value string
+		min   time.Duration
+		max   time.Duration
+	}{
+		{"", 2 * time.Second, 2 * time.Second},
+		{"5", 5 * time.Second, 5 * time.Second},
+		{"86400", maxBackoff, maxBackoff},
+		{"invalid", 2 * time.Second, 2 * time.Second},
+		{time.Now().Add(30 * time.Second).UTC().Format(http.TimeFormat), 28 * time.Second, 30 * time.Second},
+		{time.Now().Add(time.Hour).UTC().Format(http.TimeFormat), maxBackoff, maxBackoff},
+		{time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), 2 * time.Second, 2 * time.Second},
+	}
+	for _, tt := range tests {
+		resp := &http.Response{Header: http.Header{"Retry-After": []string{tt.value}}}
+		if got := retryAfter(resp, 2*time.Second); got < tt.min || got > tt.max {
+			t.Errorf("retryAfter(%q) = %v, want from %v to %v", tt.value, got, tt.min, tt.max)
+		}
+	}
+}
+
+// statusTransport responds with statuses in order, the last status is repeated
+type statusTransport struct {
+	statuses []int
+	requests int
+}
+
+func (t *statusTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	status := t.statuses[len(t.statuses)-1]
+	if t.requests < len(t.statuses) {
+		status = t.statuses[t.requests]
+	}
+	t.requests++
+	return &http.Response{StatusCode: status, Header: make(http.Header), Body: ioutil.NopCloser(strings.NewReader("")), Request: req}, nil
+}
+
+func TestRobotsUnavailable(t *testing.T) {
+	transport := &statusTransport{statuses: []int{503, 404}}
+	c := NewCrawler("habr-search", 0, 0, true)
+	c.client.Transport = transport
+	u, _ := url.Parse("https://habr.com/post/1/")
+
+	if c.robotsFor(context.Background(), u).Allowed(u.RequestURI()) {
+		t.Errorf("Path is allowed, when robots.txt responds with 503")
+	}
+	if !c.robotsFor(context.Background(), u).Allowed(u.RequestURI()) {
+		t.Errorf("Path is disallowed, when robots.txt responds with 404")
+	}
+	c.robotsFor(context.Background(), u)
+	if transport.requests != 2 {
+		t.Errorf("robots.txt is requested %d times, want 2: rules of 503 must not be cached, rules of 404 must be", transport.requests)
+	}
+}
+
+func TestParseRobotsLongestAgent(t *testing.T) {
+	robots := `User-agent: *
+Disallow: /
+
+User-agent: habr
+Disallow: /post/
+
+User-agent: habr-search
+Allow: /post/
+Disallow: /users/
+`
+	for i := 0; i < 10; i++ {
+		rules := parseRobots(strings.NewReader(robots), "habr-search/1.0")
+		if !rules.Allowed("/post/1/") || rules.Allowed("/users/") {
+			t.Fatalf("Rules of habr-search group are not used")
+		}
+	}
+	if rules := parseRobots(strings.NewReader(robots), "other-bot"); rules.Allowed("/post/1/") {
+		t.Errorf("Rules of * group are not used for other agent")
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+)
+
+const (
+	// defaultPageLimit is number of returned items, if limit is not set
+	defaultPageLimit = 20
+	// maxPageLimit is the hard limit of items, returned by one request
+	maxPageLimit = 100
+	// maxRankOffset limits depth of results, sorted by rank. Rank is calculated by search and can't be continued
+	// by value, so such results are paged by offset, which gets slow and unstable on deep pages
+	maxRankOffset = 1000
+)
+
+// Endpoints, which return cursors. Cursor is accepted only by endpoint, which returned it
+const (
+	cursorSearchPosts    = "search_posts"
+	cursorSearchComments = "search_comments"
+	cursorSearchCode     = "search_code"
+	cursorPosts          = "posts"
+	cursorUsers          = "users"
+)
+
+// Cursor is position of the last returned item in results: values of sort keys and ID.
+// Results, sorted by rank, can't be continued by value, so their cursor is Offset of the next page, which is
+// limited by maxRankOffset
+type Cursor struct {
+	Endpoint string  `json:"e,omitempty"`
+	Sort     string  `json:"s,omitempty"`
+	Values   []int64 `json:"v,omitempty"`
+	ID       int     `json:"i,omitempty"`
+	Offset   int     `json:"o,omitempty"`
+}
+
+// Encode returns opaque cursor token for endpoint
+func (c Cursor) Encode(endpoint string) string {
+	c.Endpoint = endpoint
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor parses cursor token and checks, that it was returned by the same endpoint for the same sort order
+func decodeCursor(token string, endpoint string, order SortOrder) (*Cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	c := &Cursor{}
+	if err == nil {
+		err = json.Unmarshal(data, c)
+	}
+	if err != nil || c.Offset < 0 || (!order.ByRank() && len(c.Values) != len(order)) {
+		return nil, InvalidArgumentError("Invalid cursor '%s'", token)
+	}
+	if c.Endpoint != endpoint {
+		return nil, InvalidArgumentError("Cursor was returned by another endpoint or search_type")
+	}
+	if c.Sort != order.String() {
+		return nil, InvalidArgumentError("Cursor does not match sort order, use the same sort as in the first request")
+	}
+	return c, nil
+}
+
+func int64sToFloats(values []int64) []float64 {
+	out := make([]float64, len(values))
+	for i, v := range values {
+		out[i] = float64(v)
+	}
+	return out
+}
+
+// nextCursor returns cursor of the next page, or nil if page is the last one.
+// Values of sort keys of the last item are returned by lastValues
+func nextCursor(count, offset, limit int, order SortOrder, lastValues func() ([]int64, int)) *Cursor {
+	if count == 0 || count < pageLimit(limit) {
+		return nil
+	}
+	if order.ByRank() {
+		next := nextOffset(offset, count)
+		if next >= maxRankOffset {
+			return nil
+		}
+		return &Cursor{Sort: order.String(), Offset: next}
+	}
+	values, id := lastValues()
+	return &Cursor{Sort: order.String(), Values: values, ID: id}
+}
+
+func nextPostsCursor(items []*HabrPost, offset, limit int, order SortOrder) *Cursor {
+	return nextCursor(len(items), offset, limit, order, func() ([]int64, int) {
+		last := items[len(items)-1]
+		return postSortValues(last, order), last.ID
+	})
+}
+
+func nextCommentsCursor(items []*HabrComment, offset, limit int, order SortOrder) *Cursor {
+	return nextCursor(len(items), offset, limit, order, func() ([]int64, int) {
+		last := items[len(items)-1]
+		return commentSortValues(last, order), last.ID
+	})
+}
+
+// pageLimit returns limit of items, which is applied by storage
+func pageLimit(limit int) int {
+	if limit == -1 {
+		return defaultPageLimit
+	}
+	return limit
+}
+
+func nextOffset(offset, count int) int {
+	if offset == -1 {
+		return count
+	}
+	return offset + count
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+)
+
+// Error codes are stable identifiers of API errors, returned in "code" field of error response
+const (
+	CodeInvalidArgument = "invalid_argument"
+	CodeUnauthorized    = "unauthorized"
+	CodeForbidden       = "forbidden"
+	CodeNotFound        = "not_found"
+	CodeUnavailable     = "unavailable"
+	CodeInternal        = "internal"
+)
+
+var codeHTTPStatuses = map[string]int{
+	CodeInvalidArgument: 400,
+	CodeUnauthorized:    401,
+	CodeForbidden:       403,
+	CodeNotFound:        404,
+	CodeUnavailable:     503,
+	CodeInternal:        500,
+}
+
+// APIError is error with code, which defines HTTP status of response
+type APIError struct {
+	Code    string
+	Message string
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+func newAPIError(code string, format string, args ...interface{}) error {
+	return &APIError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func InvalidArgumentError(format string, args ...interface{}) error {
+	return newAPIError(CodeInvalidArgument, format, args...)
+}
+
+func NotFoundError(format string, args ...interface{}) error {
+	return newAPIError(CodeNotFound, format, args...)
+}
+
+func UnavailableError(format string, args ...interface{}) error {
+	return newAPIError(CodeUnavailable, format, args...)
+}
+
+// ErrNotReady is returned by storage, which is not initialized or warmed up yet
+var ErrNotReady = UnavailableError("repo is not ready")
+
+// errorCode returns code of APIError, or CodeInternal for other errors
+func errorCode(err error) string {
+	if e, ok := err.(*APIError); ok {
+		return e.Code
+	}
+	return CodeInternal
+}
+
+// errorHTTPStatus returns HTTP status for error code
+func errorHTTPStatus(err error) int {
+	return codeHTTPStatuses[errorCode(err)]
+}
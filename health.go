@@ -0,0 +1,54 @@
+package main
+
+import (
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// probePaths are not checked by access control, so load balancers and orchestrators can use them
+var probePaths = map[string]bool{"/healthz": true, "/readyz": true}
+
+type HealthResponce struct {
+	Status string `json:"status"`
+}
+
+// ReadyResponce describes, if storage can serve requests. Sync status is informational,
+// failed sync does not make instance not ready
+type ReadyResponce struct {
+	Ready      bool           `json:"ready"`
+	Error      string         `json:"error,omitempty"`
+	Namespaces map[string]int `json:"namespaces"`
+	// DataAgeSec is time since publication of the latest post
+	DataAgeSec int64      `json:"data_age_sec"`
+	Sync       SyncStatus `json:"sync"`
+}
+
+// HealthzHandler responds, while process is alive
+func HealthzHandler(ctx *fasthttp.RequestCtx) {
+	respJSON(ctx, HealthResponce{Status: "ok"})
+}
+
+// ReadyzHandler responds with 200, if namespaces are open and warmed up, or with 503 otherwise
+func ReadyzHandler(ctx *fasthttp.RequestCtx) {
+	resp := ReadyResponce{Sync: getSyncStatus()}
+
+	stats, err := repo.Stats()
+	switch {
+	case err != nil:
+		resp.Error = err.Error()
+	case !stats.Ready:
+		resp.Error = "repo is not ready"
+	default:
+		resp.Ready = true
+	}
+	resp.Namespaces = map[string]int{"posts": stats.Posts, "comments": stats.Comments, "code": stats.Code, "users": stats.Users}
+	if stats.LastPostTime != 0 {
+		resp.DataAgeSec = time.Now().Unix() - stats.LastPostTime
+	}
+
+	respJSON(ctx, resp)
+	if !resp.Ready {
+		ctx.SetStatusCode(503)
+	}
+}
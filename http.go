@@ -4,18 +4,21 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 	"os"
 	"path"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/buaazp/fasthttprouter"
 	"github.com/valyala/fasthttp"
 )
 
+var httpLog = logger.With(LogFields{"component": "http"})
+
 type ErrorResponce struct {
 	Success bool   `json:"success"`
+	Code    string `json:"code"`
 	Error   string `json:"error"`
 }
 
@@ -23,11 +26,44 @@ type HabrPostView struct {
 	*HabrPost
 	Link  string `json:"link"`
 	Image string `json:"image"`
+	// Author is profile of post author, it is joined, if with_user is set
+	Author *HabrUser `json:"author,omitempty"`
+}
+
+// PostResponce is post with text in requested format
+type PostResponce struct {
+	HabrPostView
+	Format string `json:"format"`
 }
 
 type PostsResponce struct {
-	Items      []HabrPostView `json:"items"`
+	Items  []HabrPostView `json:"items"`
+	Facets Facets         `json:"facets,omitempty"`
+	// TotalCount and Facets are returned only for the first page, requested without cursor
+	TotalCount int `json:"total_count,omitempty"`
+	// NextCursor is token of the next page, it is empty for the last page
+	NextCursor string `json:"next_cursor,omitempty"`
+	ElapsedMs  int64  `json:"elapsed_ms,omitempty"`
+	Success    bool   `json:"success"`
+}
+
+type UsersResponce struct {
+	Items      []*HabrUser `json:"items"`
+	TotalCount int         `json:"total_count,omitempty"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+	ElapsedMs  int64       `json:"elapsed_ms,omitempty"`
+	Success    bool        `json:"success"`
+}
+
+type HabrCodeView struct {
+	*HabrCode
+	Link string `json:"link"`
+}
+
+type CodeResponce struct {
+	Items      []HabrCodeView `json:"items"`
 	TotalCount int            `json:"total_count,omitempty"`
+	NextCursor string         `json:"next_cursor,omitempty"`
 	ElapsedMs  int64          `json:"elapsed_ms,omitempty"`
 	Success    bool           `json:"success"`
 }
@@ -37,21 +73,43 @@ type HabrCommentView struct {
 	Link string `json:"link"`
 }
 
+type HabrCommentNode struct {
+	HabrCommentView
+	Replies []*HabrCommentNode `json:"replies,omitempty"`
+}
+
+type CommentsTreeResponce struct {
+	Items      []*HabrCommentNode `json:"items"`
+	TotalCount int                `json:"total_count,omitempty"`
+	ElapsedMs  int64              `json:"elapsed_ms,omitempty"`
+	Success    bool               `json:"success"`
+}
+
 type CommentsResponce struct {
 	Items      []HabrCommentView `json:"items"`
 	TotalCount int               `json:"total_count,omitempty"`
+	NextCursor string            `json:"next_cursor,omitempty"`
 	ElapsedMs  int64             `json:"elapsed_ms,omitempty"`
 	Success    bool              `json:"success"`
 }
 
-func respError(ctx *fasthttp.RequestCtx, httpCode int, err error) {
+// respError writes error response with HTTP status and code of error. Errors, which are not APIError, are internal
+func respError(ctx *fasthttp.RequestCtx, err error) {
 	resp := ErrorResponce{
 		Success: false,
+		Code:    errorCode(err),
 		Error:   err.Error(),
 	}
+	httpCode := errorHTTPStatus(err)
 	ctx.SetStatusCode(httpCode)
+	ctx.SetContentType("application/json; charset=utf-8")
 	ret, _ := json.Marshal(resp)
 	ctx.Write(ret)
+	if httpCode >= 500 {
+		ctxLogger(ctx).Errorf("Error response %d: %s", httpCode, err.Error())
+	} else {
+		ctxLogger(ctx).Warnf("Error response %d: %s", httpCode, err.Error())
+	}
 }
 
 func respJSON(ctx *fasthttp.RequestCtx, data interface{}) {
@@ -74,11 +132,73 @@ func convertComments(in []*HabrComment) (out []HabrCommentView) {
 	return out
 }
 
+// buildCommentsTree nests comments by ParentID. Comments, which parent is not found, are placed to the top level
+func buildCommentsTree(in []HabrCommentView) (roots []*HabrCommentNode) {
+	nodes := make(map[int]*HabrCommentNode, len(in))
+	for i := range in {
+		nodes[in[i].ID] = &HabrCommentNode{HabrCommentView: in[i]}
+	}
+
+	roots = make([]*HabrCommentNode, 0)
+	for i := range in {
+		node := nodes[in[i].ID]
+		if parent, ok := nodes[in[i].ParentID]; ok && in[i].ParentID != 0 && parent != node {
+			parent.Replies = append(parent.Replies, node)
+		} else {
+			roots = append(roots, node)
+		}
+	}
+	return roots
+}
+
+// convertCode returns views of code blocks without their index tokens
+func convertCode(in []*HabrCode) (out []HabrCodeView) {
+	out = make([]HabrCodeView, 0, len(in))
+	for _, c := range in {
+		code := *c
+		code.Tokens = ""
+		out = append(out, HabrCodeView{
+			HabrCode: &code,
+			Link:     fmt.Sprintf("https://habrahabr.ru/post/%d/", code.PostID),
+		})
+	}
+	return out
+}
+
+// joinAuthors sets profiles of authors to posts. Author is not set, if post was added by running sync, until its users are updated
+func joinAuthors(posts []HabrPostView) error {
+	nicks := make([]string, 0, len(posts))
+	for _, p := range posts {
+		if len(p.User) != 0 && !containsString(nicks, p.User) {
+			nicks = append(nicks, p.User)
+		}
+	}
+	if len(nicks) == 0 {
+		return nil
+	}
+
+	users, _, err := repo.GetUsers(nicks, -1, len(nicks), nil, defaultUsersOrder)
+	if err != nil {
+		return err
+	}
+	for i := range posts {
+		for _, u := range users {
+			if u.Nick == posts[i].User {
+				posts[i].Author = u
+			}
+		}
+	}
+	return nil
+}
+
+// convertPosts returns views of posts without HTML of text, which is returned only by GetPostHandler
 func convertPosts(in []*HabrPost) (out []HabrPostView) {
 	out = make([]HabrPostView, 0, len(in))
-	for _, post := range in {
+	for _, p := range in {
+		post := *p
+		post.HTML = ""
 		pv := HabrPostView{
-			HabrPost: post,
+			HabrPost: &post,
 			Link:     fmt.Sprintf("https://habrahabr.ru/post/%d/", post.ID),
 		}
 		if post.HasImage {
@@ -90,76 +210,367 @@ func convertPosts(in []*HabrPost) (out []HabrPostView) {
 	return out
 }
 
+func peekStrings(args *fasthttp.Args, key string) []string {
+	values := args.PeekMulti(key)
+	out := make([]string, 0, len(values))
+	for _, v := range values {
+		if len(v) != 0 {
+			out = append(out, string(v))
+		}
+	}
+	return out
+}
+
+// argsParser parses query arguments and keeps the first parse error
+type argsParser struct {
+	args *fasthttp.Args
+	err  error
+}
+
+// Uint returns value of non-negative integer argument, or -1 if argument is not set
+func (p *argsParser) Uint(name string) int {
+	if !p.args.Has(name) {
+		return -1
+	}
+	v, err := p.args.GetUint(name)
+	if err != nil && p.err == nil {
+		p.err = InvalidArgumentError("Invalid %s '%s': must be non-negative integer", name, p.args.Peek(name))
+	}
+	return v
+}
+
+// Page returns offset and limit of requested page. Cursor of page is returned, if results are
+// sorted by field, for relevancy sorted results cursor is converted to offset, and page is limited by maxRankOffset.
+// Cursor must be returned by endpoint. First is false for pages, continued by cursor: total count and facets
+// are not returned for them
+func (p *argsParser) Page(endpoint string, order SortOrder) (offset, limit int, cursor *Cursor, first bool) {
+	offset = p.Uint("offset")
+	limit = p.Uint("limit")
+	first = !p.args.Has("cursor")
+	if limit > maxPageLimit && p.err == nil {
+		p.err = InvalidArgumentError("Invalid limit %d: must not be greater than %d", limit, maxPageLimit)
+	}
+	if !first && p.err == nil {
+		if offset != -1 {
+			p.err = InvalidArgumentError("offset and cursor can't be used together")
+			return offset, limit, nil, first
+		}
+		cursor, p.err = decodeCursor(string(p.args.Peek("cursor")), endpoint, order)
+	}
+	if !order.ByRank() || p.err != nil {
+		return offset, limit, cursor, first
+	}
+
+	if cursor != nil {
+		offset, cursor = cursor.Offset, nil
+	}
+	if offset >= maxRankOffset {
+		p.err = InvalidArgumentError("Results sorted by relevance can't be paged deeper than %d items, refine query or sort by other field", maxRankOffset)
+	} else if offset != -1 && offset+pageLimit(limit) > maxRankOffset {
+		limit = maxRankOffset - offset
+	}
+	return offset, limit, nil, first
+}
+
+// SortOrder returns order from sort argument, e.g. "-likes,time", or from legacy sort_by and sort_desc arguments.
+// Only given fields are allowed, and def is returned, if order is not set
+func (p *argsParser) SortOrder(fields []string, def SortOrder) SortOrder {
+	value := string(p.args.Peek("sort"))
+	if sortBy := string(p.args.Peek("sort_by")); len(sortBy) != 0 {
+		if len(value) != 0 {
+			p.setErr(InvalidArgumentError("sort and sort_by can't be used together"))
+			return def
+		}
+		value = sortBy
+		if p.Bool("sort_desc") {
+			value = "-" + sortBy
+		}
+	}
+	if len(value) == 0 {
+		return def
+	}
+	order, err := ParseSortOrder(value, fields)
+	if err != nil {
+		p.setErr(err)
+		return def
+	}
+	return order
+}
+
+func (p *argsParser) setErr(err error) {
+	if p.err == nil {
+		p.err = err
+	}
+}
+
+// Query returns user search query from query argument and checks its syntax
+func (p *argsParser) Query() string {
+	text := string(p.args.Peek("query"))
+	if err := ParseUserQuery(text).Validate(); err != nil {
+		p.setErr(err)
+	}
+	return text
+}
+
+// Bool returns true, if argument is set to positive integer
+func (p *argsParser) Bool(name string) bool {
+	return p.Uint(name) > 0
+}
+
+func postIDFromPath(ctx *fasthttp.RequestCtx) (int, error) {
+	value := ctx.UserValue("id").(string)
+	id, err := strconv.Atoi(value)
+	if err != nil || id <= 0 {
+		return 0, InvalidArgumentError("Invalid post id '%s': must be positive integer", value)
+	}
+	return id, nil
+}
+
+func postsFilterFromArgs(p *argsParser) PostsFilter {
+	return PostsFilter{
+		Hubs:      peekStrings(p.args, "hub"),
+		Tags:      peekStrings(p.args, "tag"),
+		User:      string(p.args.Peek("user")),
+		StartTime: p.Uint("start_time"),
+		EndTime:   p.Uint("end_time"),
+		MinLikes:  p.Uint("min_likes"),
+		MinViews:  p.Uint("min_views"),
+	}
+}
+
+// facetsFromArgs parses comma separated list of facet fields
+func facetsFromArgs(args *fasthttp.Args) ([]string, error) {
+	value := string(args.Peek("facets"))
+	if len(value) == 0 {
+		return nil, nil
+	}
+
+	facets := strings.Split(value, ",")
+	for _, field := range facets {
+		valid := false
+		for _, f := range facetFields {
+			valid = valid || f == field
+		}
+		if !valid {
+			return nil, InvalidArgumentError("Invalid facet '%s'. Valid values are: %s", field, strings.Join(facetFields, ", "))
+		}
+	}
+	return facets, nil
+}
+
 func SearchPosts(ctx *fasthttp.RequestCtx) {
-	text := string(ctx.QueryArgs().Peek("query"))
-	limit, _ := ctx.QueryArgs().GetUint("limit")
-	offset, _ := ctx.QueryArgs().GetUint("offset")
-	sortBy := string(ctx.QueryArgs().Peek("sort_by"))
-	sortDesc, _ := ctx.QueryArgs().GetUint("sort_desc")
+	p := &argsParser{args: ctx.QueryArgs()}
+	text := p.Query()
+	order := p.SortOrder(postsSortFields, defaultSearchOrder)
+	offset, limit, cursor, firstPage := p.Page(cursorSearchPosts, order)
+	withUser := p.Bool("with_user")
+	filter := postsFilterFromArgs(p)
+	if p.err != nil {
+		respError(ctx, p.err)
+		return
+	}
+
+	facets, err := facetsFromArgs(ctx.QueryArgs())
+	if err != nil {
+		respError(ctx, err)
+		return
+	}
+	if !firstPage {
+		facets = nil
+	}
 
 	t := time.Now()
-	items, total, err := repo.SearchPosts(text, offset, limit, sortBy, sortDesc > 0)
+	items, itemsFacets, total, err := repo.SearchPosts(text, filter, facets, offset, limit, cursor, order)
 
 	if err != nil {
-		respError(ctx, 502, err)
+		respError(ctx, err)
 		return
 	}
 
 	resp := PostsResponce{
-		Items:      convertPosts(items),
-		TotalCount: total,
-		ElapsedMs:  int64(time.Now().Sub(t) / time.Millisecond),
-		Success:    true,
+		Items:     convertPosts(items),
+		Facets:    itemsFacets,
+		ElapsedMs: int64(time.Now().Sub(t) / time.Millisecond),
+		Success:   true,
+	}
+	if withUser {
+		if err = joinAuthors(resp.Items); err != nil {
+			respError(ctx, err)
+			return
+		}
+	}
+	if firstPage {
+		searchTotals.Observe(float64(total), "posts")
+		resp.TotalCount = total
+	}
+	if next := nextPostsCursor(items, offset, limit, order); next != nil {
+		resp.NextCursor = next.Encode(cursorSearchPosts)
 	}
 
 	respJSON(ctx, resp)
 }
 
 func GetPostsHandler(ctx *fasthttp.RequestCtx) {
-	user := string(ctx.QueryArgs().Peek("user"))
-	limit, _ := ctx.QueryArgs().GetUint("limit")
-	offset, _ := ctx.QueryArgs().GetUint("offset")
-	startTime, _ := ctx.QueryArgs().GetUint("start_time")
-	endTime, _ := ctx.QueryArgs().GetUint("end_time")
-	withComments, _ := ctx.QueryArgs().GetUint("with_comments")
+	p := &argsParser{args: ctx.QueryArgs()}
+	order := p.SortOrder(postsListSortFields, defaultPostsOrder)
+	offset, limit, cursor, firstPage := p.Page(cursorPosts, order)
+	withComments := p.Bool("with_comments")
+	withUser := p.Bool("with_user")
+	filter := postsFilterFromArgs(p)
+	if p.err != nil {
+		respError(ctx, p.err)
+		return
+	}
+
+	facets, err := facetsFromArgs(ctx.QueryArgs())
+	if err != nil {
+		respError(ctx, err)
+		return
+	}
+	if !firstPage {
+		facets = nil
+	}
 
 	t := time.Now()
-	items, total, err := repo.GetPosts(offset, limit, user, startTime, endTime, withComments > 0)
+	items, itemsFacets, total, err := repo.GetPosts(filter, facets, offset, limit, cursor, order, withComments)
 
 	if err != nil {
-		respError(ctx, 502, err)
+		respError(ctx, err)
 		return
 	}
 	resp := PostsResponce{
-		Items:      convertPosts(items),
-		TotalCount: total,
-		ElapsedMs:  int64(time.Now().Sub(t) / time.Millisecond),
-		Success:    true,
+		Items:     convertPosts(items),
+		Facets:    itemsFacets,
+		ElapsedMs: int64(time.Now().Sub(t) / time.Millisecond),
+		Success:   true,
+	}
+	if withUser {
+		if err = joinAuthors(resp.Items); err != nil {
+			respError(ctx, err)
+			return
+		}
+	}
+	if firstPage {
+		resp.TotalCount = total
+	}
+	if next := nextPostsCursor(items, offset, limit, order); next != nil {
+		resp.NextCursor = next.Encode(cursorPosts)
 	}
 
 	respJSON(ctx, resp)
 }
 
 func SearchComments(ctx *fasthttp.RequestCtx) {
-	text := string(ctx.QueryArgs().Peek("query"))
-	limit, _ := ctx.QueryArgs().GetUint("limit")
-	offset, _ := ctx.QueryArgs().GetUint("offset")
-	sortBy := string(ctx.QueryArgs().Peek("sort_by"))
-	sortDesc, _ := ctx.QueryArgs().GetUint("sort_desc")
+	p := &argsParser{args: ctx.QueryArgs()}
+	text := p.Query()
+	order := p.SortOrder(commentsSortFields, defaultSearchOrder)
+	offset, limit, cursor, firstPage := p.Page(cursorSearchComments, order)
+	if p.err != nil {
+		respError(ctx, p.err)
+		return
+	}
 
 	t := time.Now()
-	items, total, err := repo.SearchComments(text, offset, limit, sortBy, sortDesc > 0)
+	items, total, err := repo.SearchComments(text, offset, limit, cursor, order)
 
 	if err != nil {
-		respError(ctx, 502, err)
+		respError(ctx, err)
 		return
 	}
 
 	resp := CommentsResponce{
-		Items:      convertComments(items),
-		TotalCount: total,
-		ElapsedMs:  int64(time.Now().Sub(t) / time.Millisecond),
-		Success:    true,
+		Items:     convertComments(items),
+		ElapsedMs: int64(time.Now().Sub(t) / time.Millisecond),
+		Success:   true,
+	}
+	if firstPage {
+		searchTotals.Observe(float64(total), "comments")
+		resp.TotalCount = total
+	}
+	if next := nextCommentsCursor(items, offset, limit, order); next != nil {
+		resp.NextCursor = next.Encode(cursorSearchComments)
+	}
+
+	respJSON(ctx, resp)
+}
+
+func GetUsersHandler(ctx *fasthttp.RequestCtx) {
+	p := &argsParser{args: ctx.QueryArgs()}
+	order := p.SortOrder(usersSortFields, defaultUsersOrder)
+	offset, limit, cursor, firstPage := p.Page(cursorUsers, order)
+	if p.err != nil {
+		respError(ctx, p.err)
+		return
+	}
+
+	t := time.Now()
+	items, total, err := repo.GetUsers(nil, offset, limit, cursor, order)
+
+	if err != nil {
+		respError(ctx, err)
+		return
+	}
+
+	resp := UsersResponce{
+		Items:     items,
+		ElapsedMs: int64(time.Now().Sub(t) / time.Millisecond),
+		Success:   true,
+	}
+	if firstPage {
+		resp.TotalCount = total
+	}
+	if next := nextUsersCursor(items, offset, limit, order); next != nil {
+		resp.NextCursor = next.Encode(cursorUsers)
+	}
+
+	respJSON(ctx, resp)
+}
+
+func GetUserHandler(ctx *fasthttp.RequestCtx) {
+	user, err := repo.GetUser(ctx.UserValue("nick").(string))
+
+	if err != nil {
+		respError(ctx, err)
+		return
+	}
+
+	respJSON(ctx, user)
+}
+
+func SearchCode(ctx *fasthttp.RequestCtx) {
+	p := &argsParser{args: ctx.QueryArgs()}
+	text := string(ctx.QueryArgs().Peek("query"))
+	lang := strings.ToLower(string(ctx.QueryArgs().Peek("lang")))
+	for _, arg := range []string{"sort", "sort_by", "sort_desc"} {
+		if p.args.Has(arg) {
+			p.setErr(InvalidArgumentError("Code search results can't be sorted, they are sorted by relevance"))
+		}
+	}
+	offset, limit, _, firstPage := p.Page(cursorSearchCode, defaultSearchOrder)
+	if p.err != nil {
+		respError(ctx, p.err)
+		return
+	}
+
+	t := time.Now()
+	items, total, err := repo.SearchCode(text, lang, offset, limit)
+
+	if err != nil {
+		respError(ctx, err)
+		return
+	}
+
+	resp := CodeResponce{
+		Items:     convertCode(items),
+		ElapsedMs: int64(time.Now().Sub(t) / time.Millisecond),
+		Success:   true,
+	}
+	if firstPage {
+		searchTotals.Observe(float64(total), "code")
+		resp.TotalCount = total
+	}
+	if next := nextCursor(len(items), offset, limit, defaultSearchOrder, nil); next != nil {
+		resp.NextCursor = next.Encode(cursorSearchCode)
 	}
 
 	respJSON(ctx, resp)
@@ -172,41 +583,104 @@ func SearchHandler(ctx *fasthttp.RequestCtx) {
 		SearchPosts(ctx)
 	case "comments":
 		SearchComments(ctx)
+	case "code":
+		SearchCode(ctx)
 	default:
-		respError(ctx, 401, fmt.Errorf("Invalid search_type. Valid values are: 'comments' or 'posts'"))
+		respError(ctx, InvalidArgumentError("Invalid search_type '%s'. Valid values are: 'posts', 'comments' or 'code'", sortBy))
 	}
 
 }
 
+// postFormats are formats of post text, returned by GetPostHandler
+var postFormats = []string{"text", "html", "markdown"}
+
 func GetPostHandler(ctx *fasthttp.RequestCtx) {
-	id, _ := strconv.Atoi(ctx.UserValue("id").(string))
-	withComments, _ := ctx.QueryArgs().GetUint("with_comments")
+	p := &argsParser{args: ctx.QueryArgs()}
+	withComments := p.Bool("with_comments")
+	withUser := p.Bool("with_user")
+	if p.err != nil {
+		respError(ctx, p.err)
+		return
+	}
+	format := string(ctx.QueryArgs().Peek("format"))
+	if len(format) == 0 {
+		format = "text"
+	}
+	if !containsString(postFormats, format) {
+		respError(ctx, InvalidArgumentError("Invalid format '%s'. Valid values are: %s", format, strings.Join(postFormats, ", ")))
+		return
+	}
+	id, err := postIDFromPath(ctx)
+	if err != nil {
+		respError(ctx, err)
+		return
+	}
 
-	item, err := repo.GetPost(id, withComments > 0)
+	item, err := repo.GetPost(id, withComments)
 
 	if err != nil {
-		respError(ctx, 502, err)
+		respError(ctx, err)
 		return
 	}
 
-	respJSON(ctx, item)
+	views := convertPosts([]*HabrPost{item})
+	if withUser {
+		if err = joinAuthors(views); err != nil {
+			respError(ctx, err)
+			return
+		}
+	}
+	resp := PostResponce{HabrPostView: views[0], Format: format}
+	// Posts, imported before HTML was kept, have only plain text
+	switch {
+	case len(item.HTML) == 0:
+		resp.Format = "text"
+	case format == "html":
+		resp.Text = item.HTML
+	case format == "markdown":
+		resp.Text = htmlToMarkdown(item.HTML)
+	}
+
+	respJSON(ctx, resp)
 }
 
-func ConfigureHandler(ctx *fasthttp.RequestCtx) {
-	ns := ctx.UserValue("ns").(string)
-	var newCfg FTConfig
-	err := json.Unmarshal(ctx.PostBody(), &newCfg)
+func GetPostCommentsHandler(ctx *fasthttp.RequestCtx) {
+	p := &argsParser{args: ctx.QueryArgs()}
+	tree := p.Bool("tree")
+	if p.err != nil {
+		respError(ctx, p.err)
+		return
+	}
+	id, err := postIDFromPath(ctx)
 	if err != nil {
-		respError(ctx, 502, err)
+		respError(ctx, err)
 		return
 	}
-	err = repo.SetFTConfig(ns, newCfg)
+
+	t := time.Now()
+	items, err := repo.GetComments(id)
+
 	if err != nil {
-		respError(ctx, 502, err)
+		respError(ctx, err)
+		return
+	}
+
+	if tree {
+		respJSON(ctx, CommentsTreeResponce{
+			Items:      buildCommentsTree(convertComments(items)),
+			TotalCount: len(items),
+			ElapsedMs:  int64(time.Now().Sub(t) / time.Millisecond),
+			Success:    true,
+		})
 		return
 	}
-	ctx.WriteString("ok")
-	return
+
+	respJSON(ctx, CommentsResponce{
+		Items:      convertComments(items),
+		TotalCount: len(items),
+		ElapsedMs:  int64(time.Now().Sub(t) / time.Millisecond),
+		Success:    true,
+	})
 }
 
 func GetDocHandler(ctx *fasthttp.RequestCtx) {
@@ -219,7 +693,7 @@ func GetDocHandler(ctx *fasthttp.RequestCtx) {
 		target = path.Join(*webRootPath, "index.html")
 	}
 
-	log.Printf("%s", target)
+	ctxLogger(ctx).Debugf("Sending file %s", target)
 
 	ctx.SendFile(target)
 
@@ -228,43 +702,95 @@ func GetDocHandler(ctx *fasthttp.RequestCtx) {
 func HandlerWrapper(handler func(ctx *fasthttp.RequestCtx)) func(ctx *fasthttp.RequestCtx) {
 	return func(ctx *fasthttp.RequestCtx) {
 
-		ip := ctx.RemoteIP().String()
-		if ip != "127.0.0.1" && ip != "188.120.235.218" {
-			ctx.SetStatusCode(401)
-			ctx.WriteString("bad IP - gone")
+		t := time.Now()
+		reqID := requestID(ctx)
+		ctx.Response.Header.Set("X-Request-ID", reqID)
+		ip := access.ClientIP(ctx)
+		reqLog := httpLog.With(LogFields{"request_id": reqID, "ip": ip.String()})
+		ctx.SetUserValue("logger", reqLog)
+
+		defer func() {
+			route, _ := ctx.UserValue("route").(string)
+			if len(route) == 0 {
+				route = "unmatched"
+			}
+			status := strconv.Itoa(ctx.Response.StatusCode())
+			httpRequests.Inc(route, string(ctx.Method()), status)
+			httpLatency.Observe(time.Now().Sub(t).Seconds(), route, status)
+		}()
+
+		client, err := access.Check(ctx, ip)
+		if err != nil && !probePaths[string(ctx.Path())] {
+			respError(ctx, err)
 			return
 		}
+		if len(client) != 0 {
+			reqLog = reqLog.With(LogFields{"client": client})
+			ctx.SetUserValue("logger", reqLog)
+		}
 
-		t := time.Now()
 		handler(ctx)
 		latency := time.Now().Sub(t)
+		uri := redactedURI(ctx)
+
+		reqLog.With(LogFields{
+			"method":     string(ctx.Method()),
+			"uri":        uri,
+			"status":     ctx.Response.StatusCode(),
+			"bytes":      len(ctx.Response.Body()),
+			"latency_ms": float64(latency) / float64(time.Millisecond),
+			"user_agent": string(ctx.UserAgent()),
+		}).Infof("%s %s %d", string(ctx.Method()), uri, ctx.Response.StatusCode())
+	}
+}
 
-		log.Printf(
-			"%s %s %s %d %d %v %s",
-			ip,
-			string(ctx.Method()),
-			string(ctx.RequestURI()),
-			ctx.Response.StatusCode(),
-			len(ctx.Response.Body()),
-			latency,
-			string(ctx.UserAgent()),
-		)
+// httpRoute is route of HTTP server. Routes, which are not internal, must be described in OpenAPI spec
+type httpRoute struct {
+	method   string
+	path     string
+	handler  fasthttp.RequestHandler
+	internal bool
+}
+
+func httpRoutes() []httpRoute {
+	routes := []httpRoute{
+		{method: "GET", path: "/api/search", handler: SearchHandler},
+		{method: "GET", path: "/api/posts/:id", handler: GetPostHandler},
+		{method: "GET", path: "/api/posts/:id/comments", handler: GetPostCommentsHandler},
+		{method: "GET", path: "/api/posts", handler: GetPostsHandler},
+		{method: "GET", path: "/api/users/:nick", handler: GetUserHandler},
+		{method: "GET", path: "/api/users", handler: GetUsersHandler},
+		{method: "GET", path: "/api/openapi.json", handler: OpenAPIHandler},
 	}
+	routes = append(routes, adminRoutes()...)
+	return append(routes, []httpRoute{
+		{method: "GET", path: "/healthz", handler: HealthzHandler},
+		{method: "GET", path: "/readyz", handler: ReadyzHandler},
+		{method: "GET", path: "/metrics", handler: MetricsHandler},
+		{method: "GET", path: "/images/*filepath", handler: GetDocHandler, internal: true},
+		{method: "GET", path: "/static/*filepath", handler: GetDocHandler, internal: true},
+		{method: "GET", path: "/index.html", handler: GetDocHandler, internal: true},
+		{method: "GET", path: "/search", handler: GetDocHandler, internal: true},
+		{method: "GET", path: "/", handler: GetDocHandler, internal: true},
+	}...)
 }
 
-func StartHTTP(addr string) {
+// StartHTTP starts HTTP server in background. Listen and serve error is sent to returned channel
+func StartHTTP(addr string) (*fasthttp.Server, <-chan error) {
+	routes := httpRoutes()
 	router := fasthttprouter.New()
-	router.GET("/api/search", SearchHandler)
-	router.GET("/api/posts/:id", GetPostHandler)
-	router.GET("/api/posts", GetPostsHandler)
-	// router.POST("/api/configure/:ns", ConfigureHandler)
-	router.GET("/images/*filepath", GetDocHandler)
-	router.GET("/static/*filepath", GetDocHandler)
-	router.GET("/index.html", GetDocHandler)
-	router.GET("/search", GetDocHandler)
-	router.GET("/", GetDocHandler)
-	log.Printf("Starting listen fasthttp on %s", addr)
-	if err := fasthttp.ListenAndServe(addr, HandlerWrapper(router.Handler)); err != nil {
-		panic(err)
+	for _, r := range routes {
+		router.Handle(r.method, r.path, RouteWrapper(r.path, r.handler))
+	}
+	server := &fasthttp.Server{Handler: HandlerWrapper(router.Handler)}
+	errors := make(chan error, 1)
+	if err := checkAPISpec(routes); err != nil {
+		errors <- err
+		return server, errors
 	}
+	go func() {
+		httpLog.Infof("Starting listen fasthttp on %s", addr)
+		errors <- server.ListenAndServe(addr)
+	}()
+	return server, errors
 }
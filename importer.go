@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ImportState is persisted progress of import command, so interrupted import can be resumed
+type ImportState struct {
+	StartID  int `json:"start_id"`
+	FinishID int `json:"finish_id"`
+	// LastCompletedID is the highest ID, for which all IDs from StartID to it are processed
+	LastCompletedID int `json:"last_completed_id"`
+	// Failed are IDs, which were not downloaded with error reasons. Not existing posts (404) are not failures
+	Failed map[int]string `json:"failed"`
+	// Statuses are HTTP statuses of all processed IDs. 0 status means that request was not completed
+	Statuses StatusRanges `json:"statuses"`
+
+	path    string
+	savedAt time.Time
+}
+
+var importLog = logger.With(LogFields{"component": "importer"})
+
+// importStateSaveInterval is minimal time between state file saves
+const importStateSaveInterval = 10 * time.Second
+
+// StatusRange is range of IDs from From to To inclusive with the same HTTP status
+type StatusRange struct {
+	From   int `json:"from"`
+	To     int `json:"to"`
+	Status int `json:"status"`
+}
+
+// StatusRanges are sorted not overlapping ranges of IDs with statuses. Adjacent ranges with the same status are merged,
+// so statuses of sequentially imported IDs take little space
+type StatusRanges []StatusRange
+
+// Get returns status of ID, or false if ID is not processed
+func (r StatusRanges) Get(id int) (int, bool) {
+	i := sort.Search(len(r), func(i int) bool { return r[i].To >= id })
+	if i < len(r) && r[i].From <= id {
+		return r[i].Status, true
+	}
+	return 0, false
+}
+
+// Set sets status of ID
+func (r *StatusRanges) Set(id, status int) {
+	rs := *r
+	i := sort.Search(len(rs), func(i int) bool { return rs[i].To >= id })
+	if i < len(rs) && rs[i].From <= id {
+		cur := rs[i]
+		if cur.Status == status {
+			return
+		}
+		// Split range to parts before and after ID
+		parts := make([]StatusRange, 0, 3)
+		if cur.From < id {
+			parts = append(parts, StatusRange{From: cur.From, To: id - 1, Status: cur.Status})
+		}
+		parts = append(parts, StatusRange{From: id, To: id, Status: status})
+		if id < cur.To {
+			parts = append(parts, StatusRange{From: id + 1, To: cur.To, Status: cur.Status})
+		}
+		rs = append(rs[:i], append(parts, rs[i+1:]...)...)
+		if cur.From < id {
+			i++
+		}
+	} else {
+		rs = append(rs, StatusRange{})
+		copy(rs[i+1:], rs[i:])
+		rs[i] = StatusRange{From: id, To: id, Status: status}
+	}
+
+	if i+1 < len(rs) && rs[i+1].From == rs[i].To+1 && rs[i+1].Status == status {
+		rs[i].To = rs[i+1].To
+		rs = append(rs[:i+1], rs[i+2:]...)
+	}
+	if i > 0 && rs[i-1].To+1 == rs[i].From && rs[i-1].Status == status {
+		rs[i-1].To = rs[i].To
+		rs = append(rs[:i], rs[i+1:]...)
+	}
+	*r = rs
+}
+
+// UnmarshalJSON reads ranges, or {"<id>": status} map, which was saved by previous versions
+func (r *StatusRanges) UnmarshalJSON(data []byte) error {
+	var ranges []StatusRange
+	if err := json.Unmarshal(data, &ranges); err == nil {
+		*r = ranges
+		return nil
+	}
+
+	statuses := make(map[int]int)
+	if err := json.Unmarshal(data, &statuses); err != nil {
+		return err
+	}
+	ids := make([]int, 0, len(statuses))
+	for id := range statuses {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	*r = StatusRanges{}
+	for _, id := range ids {
+		r.Set(id, statuses[id])
+	}
+	return nil
+}
+
+type importResult struct {
+	id     int
+	status int
+	err    error
+}
+
+func newImportState(path string, startID, finishID int) *ImportState {
+	return &ImportState{
+		StartID:         startID,
+		FinishID:        finishID,
+		LastCompletedID: startID - 1,
+		Failed:          make(map[int]string),
+		Statuses:        StatusRanges{},
+		path:            path,
+	}
+}
+
+// loadImportState reads state from file. New state is returned, if file does not exist or was saved for different ID range
+func loadImportState(path string, startID, finishID int) *ImportState {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			importLog.Errorf("Error read import state %s: %s", path, err.Error())
+		}
+		return newImportState(path, startID, finishID)
+	}
+
+	state := newImportState(path, startID, finishID)
+	if err = json.Unmarshal(data, state); err != nil {
+		importLog.Errorf("Error parse import state %s: %s, starting from scratch", path, err.Error())
+		return newImportState(path, startID, finishID)
+	}
+
+	if state.StartID != startID || state.FinishID != finishID {
+		importLog.Warnf("Import state %s is saved for IDs %d-%d, starting from scratch", path, state.StartID, state.FinishID)
+		return newImportState(path, startID, finishID)
+	}
+	state.path = path
+	return state
+}
+
+// PendingIDs returns IDs, which were not processed yet
+func (s *ImportState) PendingIDs() []int {
+	ids := make([]int, 0)
+	for id := s.LastCompletedID + 1; id < s.FinishID; id++ {
+		if _, ok := s.Statuses.Get(id); !ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// FailedIDs returns IDs, which were failed on previous runs
+func (s *ImportState) FailedIDs() []int {
+	ids := make([]int, 0, len(s.Failed))
+	for id := range s.Failed {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+func (s *ImportState) update(res importResult) {
+	s.Statuses.Set(res.id, res.status)
+	if res.err != nil && res.status != 404 {
+		s.Failed[res.id] = res.err.Error()
+	} else {
+		delete(s.Failed, res.id)
+	}
+
+	for s.LastCompletedID+1 < s.FinishID {
+		if _, ok := s.Statuses.Get(s.LastCompletedID + 1); !ok {
+			break
+		}
+		s.LastCompletedID++
+	}
+
+	if time.Since(s.savedAt) >= importStateSaveInterval {
+		if err := s.Save(); err != nil {
+			importLog.Errorf("Error save import state %s: %s", s.path, err.Error())
+		}
+	}
+}
+
+// Save atomically writes state to file
+func (s *ImportState) Save() error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	if err = writeFileAtomic(s.path, data); err != nil {
+		return err
+	}
+	s.savedAt = time.Now()
+	return nil
+}
+
+func idRange(startID, finishID int) []int {
+	ids := make([]int, 0, finishID-startID)
+	for id := startID; id < finishID; id++ {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func dload(ctx context.Context, wg *sync.WaitGroup, dlChannel chan int, results chan<- importResult) {
+	for i := range dlChannel {
+		habrPost, imgData, err := DownloadPost(ctx, i)
+		if ctx.Err() != nil {
+			// Interrupted download is not a result, post stays pending
+			continue
+		}
+		status := httpStatusOf(err)
+		if habrPost != nil && err == nil {
+			importLog.With(LogFields{"post_id": i}).Infof("Downloaded post at %s - %s, %d comments, %d views, %d likes, %d bookmarks",
+				time.Unix(habrPost.Time, 0).Format("02.01.06"), habrPost.Title, len(habrPost.Comments), habrPost.Views, habrPost.Likes, habrPost.Favorites)
+			data, _ := json.Marshal(habrPost)
+			err = ioutil.WriteFile(fmt.Sprintf("%s/%d.json", *dumpPostsPath, i), data, 0666)
+
+			if imgData != nil {
+				ioutil.WriteFile(fmt.Sprintf("%s/%d.jpeg", filepath.Join(*webRootPath, "images"), i), imgData, 0666)
+
+			}
+		}
+
+		switch {
+		case err == nil:
+			importPages.Inc("fetched")
+		case status == 404:
+			importPages.Inc("not_found")
+		default:
+			importPages.Inc("failed")
+			importLog.With(LogFields{"post_id": i, "status": status}).Errorf("Error download post: %s", err.Error())
+		}
+		results <- importResult{id: i, status: status, err: err}
+	}
+	wg.Done()
+}
+
+// downloadFiles downloads posts with given IDs to dumpPostsPath and returns results sorted by ID.
+// If state is not nil, progress is tracked and saved to it. If context is cancelled, downloading is stopped
+// and results of already downloaded posts are returned
+func downloadFiles(ctx context.Context, ids []int, state *ImportState) []importResult {
+	dlChannel := make(chan int)
+	results := make(chan importResult)
+	wg := sync.WaitGroup{}
+	os.Mkdir(*dumpPostsPath, os.ModePerm)
+	os.Mkdir(filepath.Join(*webRootPath, "images"), os.ModePerm)
+
+	for i := 0; i < *numParallelImports; i++ {
+		wg.Add(1)
+		go dload(ctx, &wg, dlChannel, results)
+	}
+
+	done := make(chan struct{})
+	collected := make([]importResult, 0, len(ids))
+	go func() {
+		for res := range results {
+			if state != nil {
+				state.update(res)
+			}
+			collected = append(collected, res)
+		}
+		close(done)
+	}()
+
+feed:
+	for _, id := range ids {
+		select {
+		case dlChannel <- id:
+		case <-ctx.Done():
+			importLog.Warnf("Download is cancelled")
+			break feed
+		}
+	}
+
+	close(dlChannel)
+	wg.Wait()
+	close(results)
+	<-done
+
+	if state != nil {
+		if err := state.Save(); err != nil {
+			importLog.Errorf("Error save import state %s: %s", state.path, err.Error())
+		}
+		importLog.Infof("Import state: completed up to ID %d, %d failed IDs", state.LastCompletedID, len(state.Failed))
+	}
+
+	logImportSummary(collected)
+	sort.Slice(collected, func(i, j int) bool { return collected[i].id < collected[j].id })
+	return collected
+}
+
+// logImportSummary prints number of downloaded, not found and failed posts with failures grouped by reason
+func logImportSummary(results []importResult) {
+	downloaded, notFound := 0, 0
+	reasons := make(map[string]int)
+	for _, res := range results {
+		switch {
+		case res.err == nil:
+			downloaded++
+		case res.status == 404:
+			notFound++
+		case res.err == ErrDisallowedByRobots:
+			reasons["disallowed by robots.txt"]++
+		case res.status == 0:
+			reasons["network error"]++
+		case res.status == 200:
+			reasons["parse or write error"]++
+		default:
+			reasons[fmt.Sprintf("HTTP %d", res.status)]++
+		}
+	}
+
+	keys := make([]string, 0, len(reasons))
+	for reason := range reasons {
+		keys = append(keys, reason)
+	}
+	sort.Strings(keys)
+	failures := make([]string, 0, len(keys))
+	for _, reason := range keys {
+		failures = append(failures, fmt.Sprintf("%s - %d", reason, reasons[reason]))
+	}
+
+	importLog.Infof("Import summary: %d posts processed, %d downloaded, %d not found, %d failed (%s)",
+		len(results), downloaded, notFound, len(results)-downloaded-notFound, strings.Join(failures, ", "))
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fixtureTransport serves post pages from testdata/posts and 404 for other URLs
+type fixtureTransport struct{}
+
+func (fixtureTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	status, body := http.StatusNotFound, []byte("not found")
+	var id int
+	if _, err := fmt.Sscanf(req.URL.Path, "/post/%d/", &id); err == nil {
+		if data, err := ioutil.ReadFile(filepath.Join("testdata", "posts", fmt.Sprintf("%d.html", id))); err == nil {
+			status, body = http.StatusOK, data
+		}
+	}
+	return &http.Response{
+		StatusCode: status,
+		Header:     make(http.Header),
+		Body:       ioutil.NopCloser(strings.NewReader(string(body))),
+		Request:    req,
+	}, nil
+}
+
+func TestStatusRangesSet(t *testing.T) {
+	var r StatusRanges
+	for _, id := range []int{5, 3, 4, 7, 6} {
+		r.Set(id, 200)
+	}
+	r.Set(5, 404)
+	r.Set(8, 200)
+	want := StatusRanges{{From: 3, To: 4, Status: 200}, {From: 5, To: 5, Status: 404}, {From: 6, To: 8, Status: 200}}
+	if !reflect.DeepEqual(r, want) {
+		t.Fatalf("Ranges are %+v, want %+v", r, want)
+	}
+	r.Set(5, 200)
+	if want = (StatusRanges{{From: 3, To: 8, Status: 200}}); !reflect.DeepEqual(r, want) {
+		t.Fatalf("Ranges are %+v, want %+v", r, want)
+	}
+	if _, ok := r.Get(9); ok {
+		t.Errorf("Not processed ID 9 has status")
+	}
+}
+
+func TestLoadImportStateLegacyStatuses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "import")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "import.state")
+	legacy := `{"start_id":1,"finish_id":10,"last_completed_id":2,"failed":{},"statuses":{"1":200,"2":404,"5":200}}`
+	if err = ioutil.WriteFile(path, []byte(legacy), 0666); err != nil {
+		t.Fatal(err)
+	}
+	state := loadImportState(path, 1, 10)
+	want := StatusRanges{{From: 1, To: 1, Status: 200}, {From: 2, To: 2, Status: 404}, {From: 5, To: 5, Status: 200}}
+	if !reflect.DeepEqual(state.Statuses, want) {
+		t.Errorf("Statuses are %+v, want %+v", state.Statuses, want)
+	}
+	if got := state.PendingIDs(); !reflect.DeepEqual(got, []int{3, 4, 6, 7, 8, 9}) {
+		t.Errorf("PendingIDs() = %v", got)
+	}
+}
+
+func TestImportKeepsStatusesOfCompletedIDs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "import")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	prevCrawler, prevDump, prevWebRoot, prevParallel := crawler, *dumpPostsPath, *webRootPath, *numParallelImports
+	defer func() {
+		crawler, *dumpPostsPath, *webRootPath, *numParallelImports = prevCrawler, prevDump, prevWebRoot, prevParallel
+	}()
+	crawler = NewCrawler("habr-search", 0, 0, false)
+	crawler.client.Transport = fixtureTransport{}
+	*dumpPostsPath = filepath.Join(dir, "posts")
+	*webRootPath = dir
+	*numParallelImports = 2
+
+	const startID, finishID = 354207, 354210
+	path := filepath.Join(dir, "import.state")
+	state := loadImportState(path, startID, finishID)
+	downloadFiles(context.Background(), state.PendingIDs(), state)
+
+	saved := loadImportState(path, startID, finishID)
+	if saved.LastCompletedID != finishID-1 {
+		t.Errorf("LastCompletedID is %d, want %d", saved.LastCompletedID, finishID-1)
+	}
+	for id, want := range map[int]int{354207: 404, 354208: 200, 354209: 404} {
+		if status, ok := saved.Statuses.Get(id); !ok || status != want {
+			t.Errorf("Saved status of ID %d is %d (found %v), want %d", id, status, ok, want)
+		}
+	}
+	if _, err = os.Stat(filepath.Join(*dumpPostsPath, "354208.json")); err != nil {
+		t.Errorf("Post 354208 is not saved: %s", err)
+	}
+	if len(saved.PendingIDs()) != 0 || len(saved.Failed) != 0 {
+		t.Errorf("Import has pending IDs %v and failed IDs %v", saved.PendingIDs(), saved.Failed)
+	}
+}
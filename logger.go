@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// LogLevel is severity of log message
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l LogLevel) String() string {
+	return levelNames[l]
+}
+
+func parseLogLevel(name string) (LogLevel, error) {
+	for i, n := range levelNames {
+		if n == name {
+			return LogLevel(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("Unknown log level '%s'. Valid values are: debug, info, warn or error", name)
+}
+
+// LogFields are key-value pairs, attached to every message of logger
+type LogFields map[string]interface{}
+
+// Logger writes leveled messages with fields as JSON lines, or as plain text
+type Logger struct {
+	out    *logOutput
+	fields LogFields
+}
+
+type logOutput struct {
+	sync.Mutex
+	w     io.Writer
+	level LogLevel
+	json  bool
+}
+
+var logger = NewLogger(os.Stderr, LevelInfo, false)
+
+func NewLogger(w io.Writer, level LogLevel, jsonFormat bool) *Logger {
+	return &Logger{out: &logOutput{w: w, level: level, json: jsonFormat}}
+}
+
+// setupLogger configures global logger from flags
+func setupLogger() error {
+	level, err := parseLogLevel(*logLevel)
+	if err != nil {
+		return err
+	}
+	switch *logFormat {
+	case "json", "text":
+	default:
+		return fmt.Errorf("Unknown log format '%s'. Valid values are: json or text", *logFormat)
+	}
+	logger.out.Lock()
+	logger.out.level = level
+	logger.out.json = *logFormat == "json"
+	logger.out.Unlock()
+	return nil
+}
+
+// With returns logger, which adds fields to every message
+func (l *Logger) With(fields LogFields) *Logger {
+	merged := make(LogFields, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &Logger{out: l.out, fields: merged}
+}
+
+func (l *Logger) write(level LogLevel, format string, args ...interface{}) {
+	l.out.Lock()
+	defer l.out.Unlock()
+
+	if level < l.out.level {
+		return
+	}
+
+	keys := make([]string, 0, len(l.fields))
+	for k := range l.fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	msg := fmt.Sprintf(format, args...)
+	now := time.Now().Format(time.RFC3339Nano)
+	var buf bytes.Buffer
+	if l.out.json {
+		fmt.Fprintf(&buf, `{"time":"%s","level":"%s","msg":`, now, level)
+		data, _ := json.Marshal(msg)
+		buf.Write(data)
+		for _, k := range keys {
+			data, err := json.Marshal(l.fields[k])
+			if err != nil {
+				data, _ = json.Marshal(fmt.Sprint(l.fields[k]))
+			}
+			key, _ := json.Marshal(k)
+			fmt.Fprintf(&buf, ",%s:%s", key, data)
+		}
+		buf.WriteString("}\n")
+	} else {
+		fmt.Fprintf(&buf, "%s %-5s %s", now, level, msg)
+		for _, k := range keys {
+			fmt.Fprintf(&buf, " %s=%v", k, l.fields[k])
+		}
+		buf.WriteByte('\n')
+	}
+	l.out.w.Write(buf.Bytes())
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.write(LevelDebug, format, args...)
+}
+
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.write(LevelInfo, format, args...)
+}
+
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.write(LevelWarn, format, args...)
+}
+
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.write(LevelError, format, args...)
+}
+
+// Fatalf logs error and exits
+func (l *Logger) Fatalf(format string, args ...interface{}) {
+	l.write(LevelError, format, args...)
+	os.Exit(1)
+}
+
+func newRequestID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// requestID returns X-Request-ID of request, if it is set by client or proxy, or generates new one
+func requestID(ctx *fasthttp.RequestCtx) string {
+	id := string(ctx.Request.Header.Peek("X-Request-ID"))
+	if len(id) == 0 || len(id) > 64 {
+		return newRequestID()
+	}
+	for _, r := range id {
+		if r <= ' ' || r > '~' {
+			return newRequestID()
+		}
+	}
+	return id
+}
+
+// ctxLogger returns logger of request with request ID field
+func ctxLogger(ctx *fasthttp.RequestCtx) *Logger {
+	if l, ok := ctx.UserValue("logger").(*Logger); ok {
+		return l
+	}
+	return logger
+}
@@ -1,78 +1,45 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"flag"
 	"fmt"
-	"io/ioutil"
-	"log"
 	"os"
-	"path/filepath"
-	"sync"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 )
 
-var repo Repo
-
-var numParallelImports = 4
+var repo Storage
 
+var numParallelImports = flag.Int("parallelimports", 4, "Number of posts downloaded in parallel")
 var httpAddr = flag.String("httpaddr", ":8881", "HTTP listen address:port")
 var importStartID = flag.Int("startid", 353800, "Import post start ID")
 var importFinishID = flag.Int("finishid", 355000, "Import post finish ID")
-var dumpPostsPath = flag.String("dumppath", "/Users/ogerasimov/habrimport", "Path, where imported posts are stored")
-var webRootPath = flag.String("webrootpath", "/Users/ogerasimov/habrdemo-static", "Path, where HTML static data is hosted")
+var dataDir = flag.String("datadir", "data", "Path, where repo config with search tuning is stored")
+var dumpPostsPath = flag.String("dumppath", "data/posts", "Path, where imported posts are stored")
+var webRootPath = flag.String("webrootpath", "static", "Path, where HTML static data is hosted")
 var syncTimeout = flag.Int("synctimeout", 30, "Sync timeout in minutes")
-
-func dload(wg *sync.WaitGroup, dlChannel chan int) {
-	for i := range dlChannel {
-		habrPost, imgData, err := DownloadPost(i)
-		if habrPost != nil && err == nil {
-			fmt.Printf("ID %d (at %s) - %s, %d comments, %d views, %d likes, %d bookmarks\n",
-				i, time.Unix(habrPost.Time, 0).Format("02.01.06"), habrPost.Title, len(habrPost.Comments), habrPost.Views, habrPost.Likes, habrPost.Favorites)
-			data, _ := json.Marshal(habrPost)
-			ioutil.WriteFile(fmt.Sprintf("%s/%d.json", *dumpPostsPath, i), data, 0666)
-
-			if imgData != nil {
-				ioutil.WriteFile(fmt.Sprintf("%s/%d.jpeg", filepath.Join(*webRootPath, "images"), i), imgData, 0666)
-
-			}
-		} else {
-			// fmt.Printf("ID %d - error %s\n", i, err.Error())
-		}
-	}
-	wg.Done()
-}
-
-func downloadFiles() {
-	dlChannel := make(chan int)
-	wg := sync.WaitGroup{}
-	os.Mkdir(*dumpPostsPath, os.ModePerm)
-	os.Mkdir(filepath.Join(*webRootPath, "images"), os.ModePerm)
-
-	for i := 0; i < numParallelImports; i++ {
-		wg.Add(1)
-		go dload(&wg, dlChannel)
-	}
-	for i := *importStartID; i < *importFinishID; i++ {
-		dlChannel <- i
-	}
-
-	close(dlChannel)
-	wg.Wait()
-}
-
-func syncDataRoutine() {
-	for {
-		time.Sleep(time.Duration(*syncTimeout) * time.Minute)
-		log.Printf("Syncing...")
-		log.Printf("Downloading posts from ID %d to %d", *importStartID, *importFinishID)
-		downloadFiles()
-		log.Printf("Updating posts from ID %d to %d", *importStartID, *importFinishID)
-		repo.RestoreRangeFromFiles(*dumpPostsPath, *importStartID, *importFinishID)
-		repo.Done()
-		repo.Init()
-	}
-}
+var storageType = flag.String("storage", "reindexer", "Storage backend: 'reindexer' or 'memory'")
+var reindexerDSN = flag.String("dsn", "builtin:///var/lib/reindexer/habr", "Reindexer DSN")
+var importStatePath = flag.String("statefile", "import.state", "Path to import state file, which is used to resume import")
+var importRetryFailed = flag.Bool("retry-failed", false, "Import only posts, which were failed on previous import runs")
+var syncMode = flag.String("syncmode", "discover", "Sync mode: 'discover' new posts after the last stored one, or re-import 'range' from startid to finishid")
+var discoverMaxMisses = flag.Int("discovermisses", 50, "Stop discovery of new posts after this number of consecutive not found or failed IDs")
+var refreshDays = flag.Int("refreshdays", 3, "Refresh likes, views and comments of posts published during this number of days")
+var crawlRPS = flag.Float64("rps", 2, "Maximum number of requests per second to the site, 0 - unlimited")
+var crawlUserAgent = flag.String("useragent", "habr-search/1.0 (+https://github.com/olegator77/habr-search)", "User-Agent of importer requests")
+var crawlMaxRetries = flag.Int("maxretries", 5, "Number of retries of failed requests with exponential backoff")
+var crawlRobots = flag.Bool("robots", true, "Honor robots.txt rules and crawl delay")
+var adminToken = flag.String("admintoken", "", "Bearer token of admin API, only from HABR_ADMINTOKEN environment variable or config file. Admin API is disabled, if neither token nor adminauth is set")
+var adminBasicAuth = flag.String("adminauth", "", "user:password for basic auth of admin API, only from HABR_ADMINAUTH environment variable or config file")
+var accessConfigPath = flag.String("accessconfig", "", "Path to JSON file with HTTP API access control settings. Only local clients are allowed, if not set")
+var logLevel = flag.String("loglevel", "info", "Log level: debug, info, warn or error")
+var logFormat = flag.String("logformat", "json", "Log format: 'json' lines or plain 'text'")
+var shutdownTimeout = flag.Int("shutdowntimeout", 30, "Time in seconds to wait for running sync on shutdown")
+var fixturesPath = flag.String("fixturespath", "testdata/posts", "Path, where saved post pages and golden parser outputs are stored")
+var updateGolden = flag.Bool("updategolden", false, "Rewrite golden parser outputs instead of checking them")
 
 func usage() {
 	fmt.Printf(
@@ -80,30 +47,164 @@ func usage() {
 			"The available commands are:\n"+
 			" run       Run HTTP API server\n"+
 			" import    Import posts from habrhabr site\n"+
-			" load      Load imported data to reindexer\n",
+			" load      Load imported data to reindexer\n"+
+			" checkparser Check parser against saved post pages\n"+
+			" config print Print effective settings\n"+
+			"Settings are read from command line flags, %s<FLAG> environment variables and -config file\n",
 		os.Args[0],
+		configEnvPrefix,
 	)
 	os.Exit(-1)
 
 }
 
+// handleSignals returns context, which is cancelled on SIGINT or SIGTERM or by returned cancel function,
+// and channel with received signal. The second signal terminates process immediately
+func handleSignals() (context.Context, context.CancelFunc, <-chan os.Signal) {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 2)
+	received := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		sig := <-signals
+		logger.Infof("Got %s signal, shutting down", sig)
+		received <- sig
+		cancel()
+		sig = <-signals
+		logger.Errorf("Got %s signal again, exiting immediately", sig)
+		os.Exit(signalExitCode(sig))
+	}()
+	return ctx, cancel, received
+}
+
+// signalExitCode returns conventional 128+N exit code of process, interrupted by signal N
+func signalExitCode(sig os.Signal) int {
+	if s, ok := sig.(syscall.Signal); ok {
+		return 128 + int(s)
+	}
+	return 1
+}
+
+// runServer serves HTTP API and syncs data until SIGINT or SIGTERM, then stops gracefully:
+// stops accepting requests, drains in-flight ones, cancels sync and closes storage.
+// It returns process exit code
+func runServer() int {
+	ctx, cancel, interrupted := handleSignals()
+
+	repo.Init()
+	repo.WarmUp()
+
+	syncDone := make(chan struct{})
+	go func() {
+		syncDataRoutine(ctx)
+		close(syncDone)
+	}()
+
+	server, httpErrors := StartHTTP(*httpAddr)
+
+	exitCode := 0
+	select {
+	case <-interrupted:
+	case err := <-httpErrors:
+		logger.Errorf("HTTP server error: %s", err.Error())
+		exitCode = 1
+	}
+
+	if err := server.Shutdown(); err != nil {
+		logger.Errorf("Error shutdown HTTP server: %s", err.Error())
+		exitCode = 1
+	}
+	cancel()
+
+	select {
+	case <-syncDone:
+	case <-time.After(time.Duration(*shutdownTimeout) * time.Second):
+		logger.Errorf("Sync is not stopped in %d seconds, exiting without closing storage", *shutdownTimeout)
+		return 1
+	}
+
+	repo.Done()
+	logger.Infof("Shutdown complete")
+	return exitCode
+}
+
 func main() {
 	if len(os.Args) < 2 {
 		usage()
 	}
 
-	flag.CommandLine.Parse(os.Args[2:])
+	args := os.Args[2:]
+	if os.Args[1] == "config" {
+		if len(os.Args) < 3 || os.Args[2] != "print" {
+			usage()
+		}
+		args = os.Args[3:]
+	}
+
+	flag.CommandLine.Parse(args)
+	if err := loadConfig(); err != nil {
+		logger.Fatalf("%s", err.Error())
+	}
+	if err := setupLogger(); err != nil {
+		logger.Fatalf("%s", err.Error())
+	}
+
+	if os.Args[1] == "config" {
+		printConfig()
+		if err := validateConfig(); err != nil {
+			logger.Fatalf("%s", err.Error())
+		}
+		return
+	}
+
+	if err := validateConfig(); err != nil {
+		logger.Fatalf("%s", err.Error())
+	}
+
+	if os.Args[1] == "checkparser" {
+		if err := checkParserFixtures(*fixturesPath, *updateGolden); err != nil {
+			logger.Fatalf("%s", err.Error())
+		}
+		return
+	}
+
+	crawler = NewCrawler(*crawlUserAgent, *crawlRPS, *crawlMaxRetries, *crawlRobots)
+
+	var err error
+	if repo, err = newStorage(*storageType); err != nil {
+		logger.Fatalf("%s", err.Error())
+	}
 
 	switch os.Args[1] {
 	case "run":
-		repo.Init()
-		repo.WarmUp()
-		go syncDataRoutine()
-		StartHTTP(*httpAddr)
+		if access, err = loadAccessControl(*accessConfigPath); err != nil {
+			logger.Fatalf("Error load access config: %s", err.Error())
+		}
+		os.Exit(runServer())
 	case "import":
-		downloadFiles()
+		ctx, _, interrupted := handleSignals()
+		state := loadImportState(*importStatePath, *importStartID, *importFinishID)
+		if *importRetryFailed {
+			ids := state.FailedIDs()
+			logger.Infof("Retrying %d failed posts", len(ids))
+			downloadFiles(ctx, ids, state)
+		} else {
+			ids := state.PendingIDs()
+			logger.Infof("Importing %d posts, resuming after ID %d", len(ids), state.LastCompletedID)
+			downloadFiles(ctx, ids, state)
+		}
+		if ctx.Err() != nil {
+			logger.Warnf("Import is interrupted, run import again to resume it")
+			os.Exit(signalExitCode(<-interrupted))
+		}
 	case "load":
-		os.RemoveAll("/var/lib/reindexer/habr")
+		if *storageType != "reindexer" {
+			logger.Fatalf("load command is supported only by reindexer storage")
+		}
+		if strings.HasPrefix(*reindexerDSN, "builtin://") {
+			os.RemoveAll(strings.TrimPrefix(*reindexerDSN, "builtin://"))
+		}
 		repo.Init()
 		repo.RestoreAllFromFiles(*dumpPostsPath)
 		repo.Done()
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Metrics are exposed at /metrics in Prometheus text format
+
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+var resultsBuckets = []float64{0, 1, 5, 10, 50, 100, 500, 1000, 5000, 10000}
+
+var (
+	httpRequests = newCounterVec("habr_http_requests_total", "Number of HTTP requests", "route", "method", "status")
+	httpLatency  = newHistogramVec("habr_http_request_duration_seconds", "HTTP request latency", latencyBuckets, "route", "status")
+	searchTotals = newHistogramVec("habr_search_results", "Number of found documents by search type", resultsBuckets, "type")
+
+	importPages         = newCounterVec("habr_import_pages_total", "Number of processed post pages by result: fetched, not_found or failed", "result")
+	importBytes         = newCounterVec("habr_import_bytes_total", "Number of downloaded bytes by content: page or image", "content")
+	imageResizeFailures = newCounterVec("habr_image_resize_failures_total", "Number of post images, which can't be decoded or resized")
+)
+
+// metricWriters write metrics in Prometheus text format
+var metricWriters = []func(w io.Writer){
+	httpRequests.writeTo,
+	httpLatency.writeTo,
+	searchTotals.writeTo,
+	importPages.writeTo,
+	importBytes.writeTo,
+	imageResizeFailures.writeTo,
+	writeRepoMetrics,
+	writeSyncMetrics,
+}
+
+func labelsString(names, values []string, extra ...string) string {
+	pairs := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", name, strconv.Quote(values[i])))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", extra[i], strconv.Quote(extra[i+1])))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+type counterVec struct {
+	sync.Mutex
+	name   string
+	help   string
+	labels []string
+	values map[string]float64
+	keys   map[string][]string
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: make(map[string]float64), keys: make(map[string][]string)}
+}
+
+func (c *counterVec) Add(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\x00")
+	c.Lock()
+	c.values[key] += v
+	c.keys[key] = labelValues
+	c.Unlock()
+}
+
+func (c *counterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *counterVec) writeTo(w io.Writer) {
+	c.Lock()
+	defer c.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	if len(c.labels) == 0 && len(c.values) == 0 {
+		fmt.Fprintf(w, "%s 0\n", c.name)
+	}
+	for _, key := range sortedKeys(c.keys) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, labelsString(c.labels, c.keys[key]), formatFloat(c.values[key]))
+	}
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type histogramVec struct {
+	sync.Mutex
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	values  map[string]*histogram
+	keys    map[string][]string
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, values: make(map[string]*histogram), keys: make(map[string][]string)}
+}
+
+func (h *histogramVec) Observe(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\x00")
+	h.Lock()
+	defer h.Unlock()
+
+	hist, ok := h.values[key]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hist
+		h.keys[key] = labelValues
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			hist.counts[i]++
+		}
+	}
+	hist.sum += v
+	hist.count++
+}
+
+func (h *histogramVec) writeTo(w io.Writer) {
+	h.Lock()
+	defer h.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, key := range sortedKeys(h.keys) {
+		hist, labelValues := h.values[key], h.keys[key]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelsString(h.labels, labelValues, "le", formatFloat(bound)), hist.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelsString(h.labels, labelValues, "le", "+Inf"), hist.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labelsString(h.labels, labelValues), formatFloat(hist.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labelsString(h.labels, labelValues), hist.count)
+	}
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func writeGauge(w io.Writer, name, help string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", name, help, name, name, formatFloat(value))
+}
+
+func boolGauge(v bool) float64 {
+	if v {
+		return 1
+	}
+	return 0
+}
+
+func writeRepoMetrics(w io.Writer) {
+	stats, err := repo.Stats()
+	writeGauge(w, "habr_repo_ready", "1, if storage is ready to serve requests", boolGauge(err == nil && stats.Ready))
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(w, "# HELP habr_namespace_items Number of items in namespace\n# TYPE habr_namespace_items gauge\n")
+	fmt.Fprintf(w, "habr_namespace_items{namespace=\"posts\"} %d\n", stats.Posts)
+	fmt.Fprintf(w, "habr_namespace_items{namespace=\"comments\"} %d\n", stats.Comments)
+	fmt.Fprintf(w, "habr_namespace_items{namespace=\"code\"} %d\n", stats.Code)
+	fmt.Fprintf(w, "habr_namespace_items{namespace=\"users\"} %d\n", stats.Users)
+}
+
+func writeSyncMetrics(w io.Writer) {
+	status := getSyncStatus()
+	fmt.Fprintf(w, "# HELP habr_sync_runs_total Number of finished data syncs\n# TYPE habr_sync_runs_total counter\nhabr_sync_runs_total %d\n", status.Runs)
+	writeGauge(w, "habr_sync_running", "1, if data sync is running now", boolGauge(status.Running))
+	writeGauge(w, "habr_sync_last_duration_seconds", "Duration of the last data sync", float64(status.LastDurationMs)/1000)
+	writeGauge(w, "habr_sync_last_finished_timestamp_seconds", "Finish time of the last data sync", float64(status.LastFinished))
+	writeGauge(w, "habr_sync_last_success", "1, if the last data sync had no failed posts", boolGauge(status.Runs > 0 && status.LastFailed == 0))
+	writeGauge(w, "habr_sync_last_updated_posts", "Number of posts updated by the last data sync", float64(status.LastUpdated))
+	writeGauge(w, "habr_sync_last_failed_posts", "Number of posts failed by the last data sync", float64(status.LastFailed))
+}
+
+// countingReader counts bytes read from underlying reader to importBytes
+type countingReader struct {
+	io.ReadCloser
+	content string
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	importBytes.Add(float64(n), r.content)
+	return n, err
+}
+
+// RouteWrapper sets route label of request metrics
+func RouteWrapper(route string, handler func(ctx *fasthttp.RequestCtx)) func(ctx *fasthttp.RequestCtx) {
+	return func(ctx *fasthttp.RequestCtx) {
+		ctx.SetUserValue("route", route)
+		handler(ctx)
+	}
+}
+
+func MetricsHandler(ctx *fasthttp.RequestCtx) {
+	var buf bytes.Buffer
+	for _, write := range metricWriters {
+		write(&buf)
+	}
+	ctx.SetStatusCode(200)
+	ctx.SetContentType("text/plain; version=0.0.4; charset=utf-8")
+	ctx.Write(buf.Bytes())
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/valyala/fasthttp"
+)
+
+// apiParam is parameter of API operation
+type apiParam struct {
+	Name        string
+	In          string
+	Type        string
+	Description string
+	Enum        []string
+	Multi       bool
+	Required    bool
+}
+
+// apiOperation describes API route for OpenAPI spec
+type apiOperation struct {
+	Method    string
+	Path      string
+	Summary   string
+	Params    []apiParam
+	Body      interface{}
+	Responses []interface{}
+	// ContentType of successful response, application/json by default
+	ContentType string
+	Errors      []string
+	// ErrorBody is body of error responses, ErrorResponce by default
+	ErrorBody interface{}
+	Admin     bool
+}
+
+var (
+	pagingParams = []apiParam{
+		{Name: "limit", In: "query", Type: "integer", Description: fmt.Sprintf("Maximum number of returned items, %d by default and at most %d", defaultPageLimit, maxPageLimit)},
+		{Name: "offset", In: "query", Type: "integer", Description: "Number of items to skip"},
+		{Name: "cursor", In: "query", Type: "string", Description: "Token of the next page from next_cursor of previous response. Can't be used with offset. " +
+			fmt.Sprintf("Results sorted by relevance or fresh are continued by offset and can't be paged deeper than %d items", maxRankOffset)},
+	}
+	sortParams = []apiParam{
+		{Name: "sort", In: "query", Type: "string", Description: "Comma separated sort fields, '-' prefix sorts in descending order, e.g. -likes,time. " +
+			"Posts can be sorted by " + strings.Join(postsSortFields, ", ") + ", comments by " + strings.Join(commentsSortFields, ", ") +
+			". fresh is relevance blended with recency. Results are sorted by relevance, if not set. Code search results can't be sorted"},
+		{Name: "sort_by", In: "query", Type: "string", Description: "Legacy single sort field, can't be used with sort"},
+		{Name: "sort_desc", In: "query", Type: "integer", Description: "1 - sort by sort_by in descending order"},
+	}
+	postsFilterParams = []apiParam{
+		{Name: "hub", In: "query", Type: "string", Multi: true, Description: "Posts from any of hubs"},
+		{Name: "tag", In: "query", Type: "string", Multi: true, Description: "Posts with any of tags"},
+		{Name: "user", In: "query", Type: "string", Description: "Posts of user"},
+		{Name: "start_time", In: "query", Type: "integer", Description: "Posts published at or after unix time"},
+		{Name: "end_time", In: "query", Type: "integer", Description: "Posts published at or before unix time"},
+		{Name: "min_likes", In: "query", Type: "integer", Description: "Posts with at least this number of likes"},
+		{Name: "min_views", In: "query", Type: "integer", Description: "Posts with at least this number of views"},
+	}
+	facetsParam   = apiParam{Name: "facets", In: "query", Type: "string", Description: "Comma separated fields to count values of over all found posts: " + strings.Join(facetFields, ", ")}
+	postIDParam   = apiParam{Name: "id", In: "path", Type: "integer", Required: true, Description: "Post ID"}
+	withUserParam = apiParam{Name: "with_user", In: "query", Type: "integer", Description: "1 - include profiles of post authors"}
+	nsParam       = apiParam{Name: "ns", In: "path", Type: "string", Required: true, Enum: []string{"posts", "comments"}, Description: "Namespace"}
+)
+
+func params(groups ...[]apiParam) []apiParam {
+	out := make([]apiParam, 0)
+	for _, g := range groups {
+		out = append(out, g...)
+	}
+	return out
+}
+
+// apiOperations are documented routes. Every route, which is not internal, must be described here
+var apiOperations = []apiOperation{
+	{
+		Method:  "GET",
+		Path:    "/api/search",
+		Summary: "Full text search of posts or comments",
+		Params: params([]apiParam{
+			{Name: "query", In: "query", Type: "string", Description: `Search query. Supports "phrases", -excluded words, title:, text: and user: field prefixes and OR`},
+			{Name: "search_type", In: "query", Type: "string", Enum: []string{"posts", "comments", "code"}, Description: "Type of searched documents, posts by default. code searches code blocks of posts by identifiers"},
+			{Name: "lang", In: "query", Type: "string", Description: "Language of code blocks, only for search_type=code"},
+			facetsParam,
+			withUserParam,
+		}, pagingParams, sortParams, postsFilterParams),
+		Responses: []interface{}{PostsResponce{}, CommentsResponce{}, CodeResponce{}},
+		Errors:    []string{CodeInvalidArgument, CodeUnavailable},
+	},
+	{
+		Method:  "GET",
+		Path:    "/api/posts",
+		Summary: "List posts sorted by publication time",
+		Params: params([]apiParam{
+			{Name: "sort", In: "query", Type: "string", Description: "Comma separated sort fields, '-' prefix sorts in descending order. Posts can be sorted by " + strings.Join(postsListSortFields, ", ")},
+			{Name: "with_comments", In: "query", Type: "integer", Description: "1 - include comments of posts"},
+			facetsParam,
+			withUserParam,
+		}, pagingParams, postsFilterParams),
+		Responses: []interface{}{PostsResponce{}},
+		Errors:    []string{CodeInvalidArgument, CodeUnavailable},
+	},
+	{
+		Method:  "GET",
+		Path:    "/api/posts/:id",
+		Summary: "Get post by ID",
+		Params: []apiParam{
+			postIDParam,
+			{Name: "with_comments", In: "query", Type: "integer", Description: "1 - include comments of post"},
+			{Name: "format", In: "query", Type: "string", Enum: postFormats, Description: "Format of post text, text by default. Posts, imported without HTML, are returned as text"},
+			withUserParam,
+		},
+		Responses: []interface{}{PostResponce{}},
+		Errors:    []string{CodeInvalidArgument, CodeNotFound, CodeUnavailable},
+	},
+	{
+		Method:  "GET",
+		Path:    "/api/posts/:id/comments",
+		Summary: "Get comments of post",
+		Params: []apiParam{
+			postIDParam,
+			{Name: "tree", In: "query", Type: "integer", Description: "1 - return comments as tree of replies"},
+		},
+		Responses: []interface{}{CommentsResponce{}, CommentsTreeResponce{}},
+		Errors:    []string{CodeInvalidArgument, CodeUnavailable},
+	},
+	{
+		Method:  "GET",
+		Path:    "/api/users",
+		Summary: "List users, aggregated from posts and comments, sorted by total likes",
+		Params: params([]apiParam{
+			{Name: "sort", In: "query", Type: "string", Description: "Comma separated sort fields, '-' prefix sorts in descending order. Users can be sorted by " + strings.Join(usersSortFields, ", ") +
+				". -likes is default and is karma-like rating of users: total likes of their posts and comments. There is no separate karma field"},
+		}, pagingParams),
+		Responses: []interface{}{UsersResponce{}},
+		Errors:    []string{CodeInvalidArgument, CodeUnavailable},
+	},
+	{
+		Method:  "GET",
+		Path:    "/api/users/:nick",
+		Summary: "Get user profile by nick",
+		Params: []apiParam{
+			{Name: "nick", In: "path", Type: "string", Required: true, Description: "User nick"},
+		},
+		Responses: []interface{}{HabrUser{}},
+		Errors:    []string{CodeNotFound, CodeUnavailable},
+	},
+	{
+		Method:    "GET",
+		Path:      "/api/openapi.json",
+		Summary:   "OpenAPI specification of this API",
+		Responses: []interface{}{map[string]interface{}{}},
+	},
+	{
+		Method:    "GET",
+		Path:      "/admin/ftconfig/:ns",
+		Summary:   "Get full text search config of namespace",
+		Params:    []apiParam{nsParam},
+		Responses: []interface{}{FTConfigResponce{}},
+		Errors:    []string{CodeUnauthorized, CodeNotFound},
+		Admin:     true,
+	},
+	{
+		Method:    "POST",
+		Path:      "/admin/ftconfig/:ns",
+		Summary:   "Apply full text search config to namespace. Fields, missing in body, are not changed. Previous config is returned",
+		Params:    []apiParam{nsParam},
+		Body:      FTConfig{},
+		Responses: []interface{}{FTConfigResponce{}},
+		Errors:    []string{CodeInvalidArgument, CodeUnauthorized, CodeNotFound},
+		Admin:     true,
+	},
+	{
+		Method:    "GET",
+		Path:      "/healthz",
+		Summary:   "Liveness probe",
+		Responses: []interface{}{HealthResponce{}},
+	},
+	{
+		Method:    "GET",
+		Path:      "/readyz",
+		Summary:   "Readiness probe. Responds with 503, if storage is not ready",
+		Responses: []interface{}{ReadyResponce{}},
+		Errors:    []string{CodeUnavailable},
+		ErrorBody: ReadyResponce{},
+	},
+	{
+		Method:      "GET",
+		Path:        "/metrics",
+		Summary:     "Metrics in Prometheus text format",
+		ContentType: "text/plain",
+	},
+}
+
+var routeParamRe = regexp.MustCompile(`[:*]([a-z_]+)`)
+
+// openAPIPath converts router path to OpenAPI one, e.g. /api/posts/:id to /api/posts/{id}
+func openAPIPath(path string) string {
+	return routeParamRe.ReplaceAllString(path, "{$1}")
+}
+
+// schemaBuilder generates JSON schemas of Go types, named structs are placed to components
+type schemaBuilder struct {
+	components map[string]interface{}
+}
+
+func (b *schemaBuilder) schemaOf(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int64, reflect.Int32, reflect.Uint, reflect.Uint64, reflect.Uint32:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": b.schemaOf(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": b.schemaOf(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return map[string]interface{}{"type": "object"}
+		}
+		ref := map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+		if _, ok := b.components[t.Name()]; ok {
+			return ref
+		}
+		// Placeholder for recursive types, like HabrCommentNode
+		b.components[t.Name()] = nil
+		props := make(map[string]interface{})
+		required := make([]string, 0)
+		b.structProperties(t, props, &required)
+		schema := map[string]interface{}{"type": "object", "properties": props}
+		if len(required) != 0 {
+			sort.Strings(required)
+			schema["required"] = required
+		}
+		b.components[t.Name()] = schema
+		return ref
+	}
+	return map[string]interface{}{}
+}
+
+// structProperties adds JSON fields of struct to props. Fields of embedded structs are inlined, as encoding/json does
+func (b *schemaBuilder) structProperties(t reflect.Type, props map[string]interface{}, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" || (f.PkgPath != "" && !f.Anonymous) {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if f.Anonymous && len(name) == 0 {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				b.structProperties(ft, props, required)
+			}
+			continue
+		}
+		if len(name) == 0 {
+			name = f.Name
+		}
+		props[name] = b.schemaOf(f.Type)
+		if !strings.Contains(tag, ",omitempty") {
+			*required = append(*required, name)
+		}
+	}
+}
+
+func (b *schemaBuilder) responseSchema(responses []interface{}) map[string]interface{} {
+	if len(responses) == 1 {
+		return b.schemaOf(reflect.TypeOf(responses[0]))
+	}
+	schemas := make([]interface{}, 0, len(responses))
+	for _, r := range responses {
+		schemas = append(schemas, b.schemaOf(reflect.TypeOf(r)))
+	}
+	return map[string]interface{}{"oneOf": schemas}
+}
+
+func buildParameters(ps []apiParam) []interface{} {
+	out := make([]interface{}, 0, len(ps))
+	for _, p := range ps {
+		schema := map[string]interface{}{"type": p.Type}
+		if len(p.Enum) != 0 {
+			schema["enum"] = p.Enum
+		}
+		if p.Multi {
+			schema = map[string]interface{}{"type": "array", "items": schema}
+		}
+		param := map[string]interface{}{
+			"name":        p.Name,
+			"in":          p.In,
+			"description": p.Description,
+			"schema":      schema,
+		}
+		if p.Required {
+			param["required"] = true
+		}
+		if p.Multi {
+			param["explode"] = true
+		}
+		out = append(out, param)
+	}
+	return out
+}
+
+// buildOpenAPISpec generates OpenAPI 3 spec from apiOperations
+func buildOpenAPISpec() map[string]interface{} {
+	b := &schemaBuilder{components: make(map[string]interface{})}
+	paths := make(map[string]interface{})
+	errorSchema := b.schemaOf(reflect.TypeOf(ErrorResponce{}))
+
+	for _, op := range apiOperations {
+		contentType := op.ContentType
+		if len(contentType) == 0 {
+			contentType = "application/json"
+		}
+		okResponse := map[string]interface{}{"description": "Success"}
+		if len(op.Responses) != 0 {
+			okResponse["content"] = map[string]interface{}{contentType: map[string]interface{}{"schema": b.responseSchema(op.Responses)}}
+		} else {
+			okResponse["content"] = map[string]interface{}{contentType: map[string]interface{}{"schema": map[string]interface{}{"type": "string"}}}
+		}
+		responses := map[string]interface{}{"200": okResponse}
+		opErrorSchema := errorSchema
+		if op.ErrorBody != nil {
+			opErrorSchema = b.schemaOf(reflect.TypeOf(op.ErrorBody))
+		}
+		for _, code := range append(op.Errors, CodeInternal) {
+			responses[fmt.Sprint(codeHTTPStatuses[code])] = map[string]interface{}{
+				"description": "Error with code " + code,
+				"content":     map[string]interface{}{"application/json": map[string]interface{}{"schema": opErrorSchema}},
+			}
+		}
+
+		operation := map[string]interface{}{
+			"summary":   op.Summary,
+			"responses": responses,
+		}
+		if len(op.Params) != 0 {
+			operation["parameters"] = buildParameters(op.Params)
+		}
+		if op.Body != nil {
+			operation["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content":  map[string]interface{}{"application/json": map[string]interface{}{"schema": b.schemaOf(reflect.TypeOf(op.Body))}},
+			}
+		}
+		if op.Admin {
+			operation["security"] = []interface{}{map[string]interface{}{"bearerAuth": []string{}}, map[string]interface{}{"basicAuth": []string{}}}
+		}
+
+		path := openAPIPath(op.Path)
+		item, ok := paths[path].(map[string]interface{})
+		if !ok {
+			item = make(map[string]interface{})
+			paths[path] = item
+		}
+		item[strings.ToLower(op.Method)] = operation
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.0",
+		"info": map[string]interface{}{
+			"title":       "habr-search API",
+			"description": "Full text search by habrahabr.ru posts and comments",
+			"version":     "1.0",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": b.components,
+			"securitySchemes": map[string]interface{}{
+				"bearerAuth": map[string]interface{}{"type": "http", "scheme": "bearer"},
+				"basicAuth":  map[string]interface{}{"type": "http", "scheme": "basic"},
+			},
+		},
+	}
+}
+
+// checkAPISpec returns error, if some route, which is not internal, is not described in apiOperations
+func checkAPISpec(routes []httpRoute) error {
+	documented := make(map[string]bool)
+	for _, op := range apiOperations {
+		documented[op.Method+" "+op.Path] = true
+	}
+
+	missing := make([]string, 0)
+	for _, r := range routes {
+		if !r.internal && !documented[r.method+" "+r.path] {
+			missing = append(missing, r.method+" "+r.path)
+		}
+	}
+	if len(missing) != 0 {
+		return fmt.Errorf("Routes are missing in OpenAPI spec: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+var (
+	openAPISpecOnce sync.Once
+	openAPISpecJSON []byte
+)
+
+func OpenAPIHandler(ctx *fasthttp.RequestCtx) {
+	openAPISpecOnce.Do(func() {
+		openAPISpecJSON, _ = json.MarshalIndent(buildOpenAPISpec(), "", "  ")
+	})
+	ctx.SetStatusCode(200)
+	ctx.SetContentType("application/json; charset=utf-8")
+	ctx.Write(openAPISpecJSON)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// withAdminRoutes enables admin API for duration of test
+func withAdminRoutes() func() {
+	prevToken := *adminToken
+	*adminToken = "test-token"
+	return func() { *adminToken = prevToken }
+}
+
+func TestAPISpecDescribesAllRoutes(t *testing.T) {
+	defer withAdminRoutes()()
+
+	routes := httpRoutes()
+	hasAdmin, hasInternal := false, false
+	for _, r := range routes {
+		hasAdmin = hasAdmin || strings.HasPrefix(r.path, "/admin/")
+		hasInternal = hasInternal || r.internal
+	}
+	if !hasAdmin || !hasInternal {
+		t.Fatalf("httpRoutes() must contain admin and internal routes, got admin %v, internal %v", hasAdmin, hasInternal)
+	}
+	if err := checkAPISpec(routes); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAPISpecHasNoStaleOperations(t *testing.T) {
+	defer withAdminRoutes()()
+
+	routes := make(map[string]bool)
+	for _, r := range httpRoutes() {
+		routes[r.method+" "+r.path] = true
+	}
+	for _, op := range apiOperations {
+		if !routes[op.Method+" "+op.Path] {
+			t.Errorf("Operation %s %s is described in OpenAPI spec, but is not routed", op.Method, op.Path)
+		}
+	}
+}
+
+func TestCheckAPISpecFailsOnMissingRoute(t *testing.T) {
+	routes := []httpRoute{
+		{method: "GET", path: "/api/search", handler: SearchHandler},
+		{method: "GET", path: "/api/undocumented", handler: SearchHandler},
+		{method: "GET", path: "/static/*filepath", handler: GetDocHandler, internal: true},
+	}
+	err := checkAPISpec(routes)
+	if err == nil || !strings.Contains(err.Error(), "GET /api/undocumented") || strings.Contains(err.Error(), "/static/") {
+		t.Errorf("checkAPISpec() = %v, want error about GET /api/undocumented only", err)
+	}
+}
+
+func TestOpenAPISpecPaths(t *testing.T) {
+	spec := buildOpenAPISpec()
+	paths := spec["paths"].(map[string]interface{})
+	for _, op := range apiOperations {
+		item, ok := paths[openAPIPath(op.Path)].(map[string]interface{})
+		if !ok || item[strings.ToLower(op.Method)] == nil {
+			t.Errorf("Spec has no operation %s %s", op.Method, openAPIPath(op.Path))
+		}
+	}
+	if _, ok := paths["/api/posts/{id}"]; !ok {
+		t.Errorf("Route parameters are not converted to OpenAPI path parameters")
+	}
+
+	readyz := paths["/readyz"].(map[string]interface{})["get"].(map[string]interface{})
+	notReady := readyz["responses"].(map[string]interface{})["503"].(map[string]interface{})
+	schema := notReady["content"].(map[string]interface{})["application/json"].(map[string]interface{})["schema"].(map[string]interface{})
+	if schema["$ref"] != "#/components/schemas/ReadyResponce" {
+		t.Errorf("503 response of /readyz has schema %v, want ReadyResponce", schema)
+	}
+}
@@ -2,12 +2,14 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"image"
 	"image/gif"
 	"image/jpeg"
 	"image/png"
-	"net/http"
+	"io"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
@@ -16,6 +18,8 @@ import (
 	"github.com/nfnt/resize"
 )
 
+var parserLog = logger.With(LogFields{"component": "parser"})
+
 var months = map[string]int{"января": 1, "февраля": 2, "марта": 3, "апреля": 4, "мая": 5, "июня": 6, "июля": 7, "августа": 8, "сентября": 9, "октября": 10, "ноября": 11, "декабря": 12}
 
 func parseTime(htime string) (t time.Time, err error) {
@@ -62,29 +66,62 @@ func parseTime(htime string) (t time.Time, err error) {
 
 }
 
-func downloadAndResizeImage(url string) (out []byte, err error) {
-	resp, err := http.Get(url)
+// HTTPStatusError is returned when site responds with non 200 status
+type HTTPStatusError struct {
+	URL        string
+	StatusCode int
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("%s - Got %d status", e.URL, e.StatusCode)
+}
+
+// httpStatusOf returns HTTP status of download result: 200 on success or parse error, or 0 if request was not completed
+func httpStatusOf(err error) int {
+	switch e := err.(type) {
+	case nil:
+		return 200
+	case *HTTPStatusError:
+		return e.StatusCode
+	case *url.Error:
+		return 0
+	}
+	if err == ErrDisallowedByRobots || err == context.Canceled || err == context.DeadlineExceeded {
+		return 0
+	}
+	return 200
+}
+
+func downloadAndResizeImage(ctx context.Context, url string) (out []byte, err error) {
+	resp, err := crawler.Get(ctx, url)
 
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
+	body := &countingReader{resp.Body, "image"}
+	defer body.Close()
 
 	if resp.StatusCode != 200 {
 		return nil, fmt.Errorf("%s - Got %d status", url, resp.StatusCode)
 	}
 
+	defer func() {
+		if err != nil {
+			imageResizeFailures.Inc()
+		}
+	}()
+
 	ctype := resp.Header.Get("content-type")
 
 	var img image.Image
 
 	switch ctype {
 	case "image/png":
-		img, err = png.Decode(resp.Body)
+		img, err = png.Decode(body)
 	case "image/jpeg", "image/jpg":
-		img, err = jpeg.Decode(resp.Body)
+		img, err = jpeg.Decode(body)
 	case "image/gif":
-		img, err = gif.Decode(resp.Body)
+		img, err = gif.Decode(body)
 	default:
 		return nil, fmt.Errorf("%s - Unknown image type %s", url, ctype)
 	}
@@ -103,16 +140,71 @@ func downloadAndResizeImage(url string) (out []byte, err error) {
 	return buf.Bytes(), nil
 }
 
-func DownloadPost(ID int) (*HabrPost, []byte, error) {
+// commentParent returns parent comment ID and nesting depth of comment. Every comment is placed
+// into own <li>, and replies are nested into parent's <li>
+func commentParent(s *goquery.Selection) (parentID int, depth int) {
+	items := s.ParentsFiltered("li.content-list__item_comment")
+	if items.Length() < 2 {
+		return 0, 0
+	}
+
+	parentIDStr, ok := items.Eq(1).ChildrenFiltered("div.comment").Attr("id")
+	if !ok {
+		parentIDStr, _ = s.SiblingsFiltered("span.parent_id").Attr("data-parent_id")
+	}
+	parentID, _ = strconv.Atoi(strings.TrimPrefix(parentIDStr, "comment_"))
+
+	return parentID, items.Length() - 1
+}
 
+func fetchPostHTML(ctx context.Context, ID int) (io.ReadCloser, error) {
 	url := fmt.Sprintf("https://habrahabr.ru/post/%d/", ID)
 
-	doc, err := goquery.NewDocument(url)
+	resp, err := crawler.Get(ctx, url)
+	if err != nil {
+		return nil, err
+	}
 
+	if resp.StatusCode != 200 {
+		resp.Body.Close()
+		return nil, &HTTPStatusError{URL: url, StatusCode: resp.StatusCode}
+	}
+	return &countingReader{resp.Body, "page"}, nil
+}
+
+// DownloadPost fetches post page from habrahabr.ru, parses it and downloads post image thumbnail
+func DownloadPost(ctx context.Context, ID int) (*HabrPost, []byte, error) {
+	body, err := fetchPostHTML(ctx, ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer body.Close()
+
+	habrPost, imgURL, err := ParsePostHTML(ID, body)
 	if err != nil {
 		return nil, nil, err
 	}
 
+	var imgData []byte
+	if len(imgURL) != 0 {
+		imgData, err = downloadAndResizeImage(ctx, imgURL)
+		if imgData != nil && err == nil {
+			habrPost.HasImage = true
+		}
+	}
+
+	return habrPost, imgData, nil
+}
+
+// ParsePostHTML parses post page HTML. It returns post and URL of the first image in post text, if any.
+// It does not make any network requests.
+func ParsePostHTML(ID int, r io.Reader) (*HabrPost, string, error) {
+	doc, err := goquery.NewDocumentFromReader(r)
+
+	if err != nil {
+		return nil, "", err
+	}
+
 	var dpost, dcomments, dstats *goquery.Selection
 
 	doc.Find("div").Each(func(i int, s *goquery.Selection) {
@@ -130,23 +222,19 @@ func DownloadPost(ID int) (*HabrPost, []byte, error) {
 	})
 
 	if dpost == nil {
-		return nil, nil, fmt.Errorf("Data not found")
+		return nil, "", fmt.Errorf("Data not found")
 	}
 
 	habrPost := &HabrPost{}
-	var imgData []byte
+	imgURL := ""
 	dpost.Find("div").Each(func(i int, s *goquery.Selection) {
 		if className, ok := s.Attr("class"); ok {
 			if strings.Index(className, "post__text") >= 0 {
 				habrPost.Text = s.Text()
-				img := s.Find("img").First()
-				if img != nil {
-					if srcURL, ok := img.Attr("src"); ok {
-						imgData, err = downloadAndResizeImage(srcURL)
-						if imgData != nil && err == nil {
-							habrPost.HasImage = true
-						}
-					}
+				habrPost.HTML = sanitizeHTML(s)
+				habrPost.Code = parseCodeBlocks(ID, s)
+				if srcURL, ok := s.Find("img").First().Attr("src"); ok {
+					imgURL = srcURL
 				}
 			}
 		}
@@ -171,7 +259,7 @@ func DownloadPost(ID int) (*HabrPost, []byte, error) {
 			if strings.Index(className, "post__time") >= 0 {
 				t, err := parseTime(s.Text())
 				if err != nil {
-					fmt.Printf("Error parsing time %s", err.Error())
+					parserLog.With(LogFields{"post_id": ID}).Warnf("Error parsing time %s", err.Error())
 				}
 				habrPost.Time = t.Unix()
 			}
@@ -194,6 +282,7 @@ func DownloadPost(ID int) (*HabrPost, []byte, error) {
 							comment.ID = commentID
 						}
 					}
+					comment.ParentID, comment.Depth = commentParent(s)
 
 					s.Find("div").Each(func(i int, s *goquery.Selection) {
 						if className, ok := s.Attr("class"); ok {
@@ -217,7 +306,7 @@ func DownloadPost(ID int) (*HabrPost, []byte, error) {
 							if strings.Index(className, "comment__date-time") >= 0 {
 								t, err := parseTime(s.Text())
 								if err != nil {
-									fmt.Printf("Error parsing time %s", err.Error())
+									parserLog.With(LogFields{"post_id": ID}).Warnf("Error parsing time %s", err.Error())
 								}
 								comment.Time = t.Unix()
 							}
@@ -259,5 +348,5 @@ func DownloadPost(ID int) (*HabrPost, []byte, error) {
 
 	habrPost.ID = ID
 
-	return habrPost, imgData, nil
+	return habrPost, imgURL, nil
 }
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestParserGolden compares parser output for saved post pages with golden files.
+// Golden files are rewritten by: go test -run TestParserGolden -args -updategolden
+func TestParserGolden(t *testing.T) {
+	pages, err := filepath.Glob(filepath.Join("testdata", "posts", "*.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pages) == 0 {
+		t.Fatal("No fixtures found in testdata/posts")
+	}
+
+	for _, page := range pages {
+		goldenPath := strings.TrimSuffix(page, ".html") + ".golden.json"
+		t.Run(filepath.Base(page), func(t *testing.T) {
+			got, err := parseFixture(page)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if *updateGolden {
+				if err = ioutil.WriteFile(goldenPath, got, 0666); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+
+			want, err := ioutil.ReadFile(goldenPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("Parser output differs from %s:\n%s", goldenPath, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// parsedPostFixture is golden output of ParsePostHTML for saved post page
+type parsedPostFixture struct {
+	Post     *HabrPost `json:"post,omitempty"`
+	ImageURL string    `json:"image_url,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+func parseFixture(htmlPath string) ([]byte, error) {
+	id, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(htmlPath), ".html"))
+	if err != nil {
+		return nil, fmt.Errorf("Fixture file name must be <post id>.html: %s", htmlPath)
+	}
+
+	f, err := os.Open(htmlPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fixture := parsedPostFixture{}
+	if fixture.Post, fixture.ImageURL, err = ParsePostHTML(id, f); err != nil {
+		fixture.Error = err.Error()
+	}
+
+	out, err := json.MarshalIndent(fixture, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(out, '\n'), nil
+}
+
+// checkParserFixtures parses every <id>.html page in dir and compares result with <id>.golden.json.
+// If update is set, golden files are rewritten with current parser output instead.
+func checkParserFixtures(dir string, update bool) error {
+	pages, err := filepath.Glob(filepath.Join(dir, "*.html"))
+	if err != nil {
+		return err
+	}
+	if len(pages) == 0 {
+		return fmt.Errorf("No fixtures found in %s", dir)
+	}
+
+	failed := 0
+	for _, page := range pages {
+		goldenPath := strings.TrimSuffix(page, ".html") + ".golden.json"
+
+		got, err := parseFixture(page)
+		if err != nil {
+			return err
+		}
+
+		if update {
+			if err = ioutil.WriteFile(goldenPath, got, 0666); err != nil {
+				return err
+			}
+			fmt.Printf("UPDATED %s\n", goldenPath)
+			continue
+		}
+
+		want, err := ioutil.ReadFile(goldenPath)
+		if err != nil {
+			return err
+		}
+
+		if !bytes.Equal(got, want) {
+			failed++
+			fmt.Printf("FAIL %s: parser output differs from %s\n%s\n", page, goldenPath, got)
+		} else {
+			fmt.Printf("ok   %s\n", page)
+		}
+	}
+
+	if failed != 0 {
+		return fmt.Errorf("%d of %d fixtures failed", failed, len(pages))
+	}
+	return nil
+}
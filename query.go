@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// maxQueryTerms limits number of terms in user query
+const maxQueryTerms = 9
+
+// queryFields are field names, which can be used as term prefixes in user query, e.g. title:golang
+var queryFields = []string{"title", "text", "user"}
+
+// postsQueryFields and commentsQueryFields are prefixes, available for namespaces
+var (
+	postsQueryFields    = []string{"title", "text", "user"}
+	commentsQueryFields = []string{"text", "user"}
+)
+
+// QueryTerm is single word or phrase of user query
+type QueryTerm struct {
+	Words   []string
+	Phrase  bool
+	Exclude bool
+	// Optional terms are joined with OR to neighbour terms. At least one of them must match,
+	// so query can't contain other required terms, see Validate
+	Optional bool
+	Field    string
+}
+
+// UserQuery is parsed user search query. Supported syntax:
+//   - "exact phrase"
+//   - -excluded, -"excluded phrase"
+//   - field:term, field:"phrase" for fields from queryFields
+//   - term OR term
+//   - \ escapes next symbol, e.g. \-term, \"term, c\+\+
+type UserQuery struct {
+	Terms []QueryTerm
+	// orGroups is number of groups of terms, joined with OR
+	orGroups int
+}
+
+func isTermRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// splitWords splits text to words of letters and digits. '-', '+' and '/' are kept inside words, like "e-mail" or "c++",
+// escaped symbols are kept as is
+func splitWords(text []rune, escaped []bool) []string {
+	words := make([]string, 0, 1)
+	var cur bytes.Buffer
+	flush := func() {
+		if word := strings.TrimRight(cur.String(), "-/"); len(word) > 0 {
+			words = append(words, word)
+		}
+		cur.Reset()
+	}
+
+	for i, r := range text {
+		switch {
+		case escaped[i] || isTermRune(r):
+			cur.WriteRune(r)
+		case strings.ContainsRune("-+/", r) && cur.Len() > 0:
+			cur.WriteRune(r)
+		default:
+			flush()
+		}
+	}
+	flush()
+	return words
+}
+
+// ParseUserQuery parses user search query
+func ParseUserQuery(input string) UserQuery {
+	q := UserQuery{}
+	in := []rune(input)
+	pos := 0
+	orNext := false
+
+	for pos < len(in) && len(q.Terms) < maxQueryTerms {
+		for pos < len(in) && unicode.IsSpace(in[pos]) {
+			pos++
+		}
+		if pos >= len(in) {
+			break
+		}
+
+		term := QueryTerm{}
+		switch in[pos] {
+		case '-':
+			term.Exclude = true
+			pos++
+		case '+':
+			pos++
+		}
+
+		// Field prefix. Spaces after it are skipped, so "title: golang" is scoped as "title:golang"
+		for _, f := range queryFields {
+			if strings.HasPrefix(string(in[pos:]), f+":") {
+				term.Field = f
+				pos += len(f) + 1
+				for pos < len(in) && unicode.IsSpace(in[pos]) {
+					pos++
+				}
+				break
+			}
+		}
+
+		var text []rune
+		var escaped []bool
+		if pos < len(in) && in[pos] == '"' {
+			term.Phrase = true
+			pos++
+			for pos < len(in) && in[pos] != '"' {
+				if in[pos] == '\\' && pos+1 < len(in) {
+					pos++
+				}
+				text = append(text, in[pos])
+				escaped = append(escaped, false)
+				pos++
+			}
+			pos++
+		} else {
+			for pos < len(in) && !unicode.IsSpace(in[pos]) && in[pos] != '"' {
+				isEscaped := false
+				if in[pos] == '\\' && pos+1 < len(in) {
+					pos++
+					isEscaped = true
+				}
+				text = append(text, in[pos])
+				escaped = append(escaped, isEscaped)
+				pos++
+			}
+			if string(text) == "OR" && !term.Exclude && len(term.Field) == 0 && !escaped[0] {
+				if len(q.Terms) > 0 && !q.Terms[len(q.Terms)-1].Exclude {
+					if !q.Terms[len(q.Terms)-1].Optional {
+						q.orGroups++
+					}
+					q.Terms[len(q.Terms)-1].Optional = true
+					orNext = true
+				}
+				continue
+			}
+		}
+
+		term.Words = splitWords(text, escaped)
+		if len(term.Words) == 0 {
+			continue
+		}
+
+		if !term.Phrase && len(term.Words) > 1 {
+			// Punctuation inside word, e.g. "foo,bar" - make separate terms
+			for _, word := range term.Words {
+				t := term
+				t.Words = []string{word}
+				t.Optional = orNext
+				q.Terms = append(q.Terms, t)
+			}
+		} else {
+			term.Optional = orNext
+			q.Terms = append(q.Terms, term)
+		}
+		orNext = false
+	}
+
+	if len(q.Terms) > maxQueryTerms {
+		q.Terms = q.Terms[:maxQueryTerms]
+	}
+	return q
+}
+
+// Validate checks, that terms joined with OR are the only not excluded terms of query. Reindexer DSL can't
+// require one of OR terms together with other terms, e.g. "golang OR rust tutorial" would match any post about tutorial
+func (q UserQuery) Validate() error {
+	required := 0
+	for _, t := range q.Terms {
+		if !t.Exclude && !t.Optional {
+			required++
+		}
+	}
+	if q.orGroups > 1 || (q.orGroups == 1 && required > 0) {
+		return InvalidArgumentError("OR can't be combined with other terms: search for alternatives joined with OR, e.g. 'golang OR rust', and optionally -excluded terms")
+	}
+	return nil
+}
+
+// IsEmpty returns true, if query has nothing to search. Single short word is considered empty too
+func (q UserQuery) IsEmpty() bool {
+	positive := 0
+	for _, t := range q.Terms {
+		if !t.Exclude {
+			positive++
+		}
+	}
+	if positive == 0 {
+		return true
+	}
+	if len(q.Terms) == 1 {
+		t := q.Terms[0]
+		return !t.Phrase && len([]rune(t.Words[0])) <= 2
+	}
+	return false
+}
+
+// Words returns all words of not excluded terms in lower case
+func (q UserQuery) Words() []string {
+	words := make([]string, 0, len(q.Terms))
+	for _, t := range q.Terms {
+		if !t.Exclude {
+			for _, w := range t.Words {
+				words = append(words, strings.ToLower(w))
+			}
+		}
+	}
+	return words
+}
+
+func escapeFullTextDSL(word string) string {
+	var out bytes.Buffer
+	for _, r := range word {
+		if !isTermRune(r) {
+			out.WriteByte('\\')
+		}
+		out.WriteRune(r)
+	}
+	return out.String()
+}
+
+// ReindexerDSL compiles query to reindexer full text DSL. defaultFields are boosted fields for terms without field prefix,
+// and fields are names of fields available in the index; prefixes of other fields are ignored
+func (q UserQuery) ReindexerDSL(defaultFields string, fields []string) string {
+	if q.IsEmpty() {
+		return ""
+	}
+
+	if len(defaultFields) == 0 {
+		defaultFields = "*"
+	}
+
+	var output bytes.Buffer
+	curFields := ""
+	for _, t := range q.Terms {
+		termFields := defaultFields
+		for _, f := range fields {
+			if f == t.Field {
+				termFields = f
+			}
+		}
+		if termFields != curFields {
+			fmt.Fprintf(&output, "@%s ", termFields)
+			curFields = termFields
+		}
+
+		switch {
+		case t.Exclude:
+			output.WriteByte('-')
+		case !t.Optional:
+			output.WriteByte('+')
+		}
+
+		if t.Phrase {
+			output.WriteByte('"')
+			for i, w := range t.Words {
+				if i != 0 {
+					output.WriteByte(' ')
+				}
+				output.WriteString(escapeFullTextDSL(w))
+			}
+			output.WriteString("\" ")
+			continue
+		}
+
+		word := escapeFullTextDSL(t.Words[0])
+		switch termLen := len([]rune(t.Words[0])); {
+		case t.Exclude:
+			output.WriteString(word)
+		case termLen >= 3:
+			// enable typos search from 3 symbols in term
+			output.WriteString("*" + word + "~*")
+		case termLen >= 2:
+			// enable prefix from 2 symbol
+			output.WriteString(word + "~*")
+		default:
+			output.WriteString(word)
+		}
+		output.WriteByte(' ')
+	}
+
+	return output.String()
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseUserQuery(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []QueryTerm
+	}{
+		{"words", "golang tutorial", []QueryTerm{{Words: []string{"golang"}}, {Words: []string{"tutorial"}}}},
+		{"phrase", `"exact phrase"`, []QueryTerm{{Words: []string{"exact", "phrase"}, Phrase: true}}},
+		{"unterminated phrase", `"exact phrase`, []QueryTerm{{Words: []string{"exact", "phrase"}, Phrase: true}}},
+		{"excluded word", "golang -java", []QueryTerm{{Words: []string{"golang"}}, {Words: []string{"java"}, Exclude: true}}},
+		{"excluded phrase", `-"bad phrase" golang`, []QueryTerm{{Words: []string{"bad", "phrase"}, Phrase: true, Exclude: true}, {Words: []string{"golang"}}}},
+		{"field prefix", "title:golang", []QueryTerm{{Words: []string{"golang"}, Field: "title"}}},
+		{"field prefix with space", "title: golang tutorial", []QueryTerm{{Words: []string{"golang"}, Field: "title"}, {Words: []string{"tutorial"}}}},
+		{"field phrase with space", `text:  "some phrase"`, []QueryTerm{{Words: []string{"some", "phrase"}, Phrase: true, Field: "text"}}},
+		{"trailing field prefix", "golang title:", []QueryTerm{{Words: []string{"golang"}}}},
+		{"field phrase", `text:"some phrase"`, []QueryTerm{{Words: []string{"some", "phrase"}, Phrase: true, Field: "text"}}},
+		{"unknown field", "comment:foo", []QueryTerm{{Words: []string{"comment"}}, {Words: []string{"foo"}}}},
+		{"or", "golang OR rust", []QueryTerm{{Words: []string{"golang"}, Optional: true}, {Words: []string{"rust"}, Optional: true}}},
+		{"lowercase or is word", "golang or rust", []QueryTerm{{Words: []string{"golang"}}, {Words: []string{"or"}}, {Words: []string{"rust"}}}},
+		{"or after excluded", "-java OR rust", []QueryTerm{{Words: []string{"java"}, Exclude: true}, {Words: []string{"rust"}}}},
+		{"escaped plus", `c\+\+`, []QueryTerm{{Words: []string{"c++"}}}},
+		{"escaped minus", `\-minus`, []QueryTerm{{Words: []string{"-minus"}}}},
+		{"escaped or", `\OR golang`, []QueryTerm{{Words: []string{"OR"}}, {Words: []string{"golang"}}}},
+		{"escaped quote", `\"golang`, []QueryTerm{{Words: []string{`"golang`}}}},
+		{"punctuation", "foo,bar", []QueryTerm{{Words: []string{"foo"}}, {Words: []string{"bar"}}}},
+		{"leading ors", "OR OR golang", []QueryTerm{{Words: []string{"golang"}}}},
+		{"trailing or", "golang OR", []QueryTerm{{Words: []string{"golang"}, Optional: true}}},
+		{"only or", "OR", nil},
+		{"empty", "", nil},
+		{"spaces", "   ", nil},
+		{"only punctuation", "-- , !", nil},
+	}
+	for _, tt := range tests {
+		if got := ParseUserQuery(tt.input).Terms; !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: ParseUserQuery(%q) = %+v, want %+v", tt.name, tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestParseUserQueryLimitsTerms(t *testing.T) {
+	q := ParseUserQuery("a1 a2 a3 a4 a5 a6 a7 a8 a9 a10 a11")
+	if len(q.Terms) != maxQueryTerms {
+		t.Errorf("ParseUserQuery returned %d terms, want %d", len(q.Terms), maxQueryTerms)
+	}
+}
+
+func TestUserQueryValidate(t *testing.T) {
+	tests := []struct {
+		input string
+		valid bool
+	}{
+		{"golang tutorial", true},
+		{"golang OR rust", true},
+		{"golang OR rust OR python", true},
+		{"golang OR rust -java", true},
+		{`golang OR "go lang"`, true},
+		{"user:foo OR user:bar", true},
+		{"golang OR", true},
+		{"OR OR golang", true},
+		{"", true},
+		{"golang OR rust tutorial", false},
+		{"tutorial golang OR rust", false},
+		{"golang OR rust go OR lang", false},
+		{"foo,bar OR baz", false},
+	}
+	for _, tt := range tests {
+		err := ParseUserQuery(tt.input).Validate()
+		if (err == nil) != tt.valid {
+			t.Errorf("ParseUserQuery(%q).Validate() = %v, want valid %v", tt.input, err, tt.valid)
+		}
+		if apiErr, ok := err.(*APIError); err != nil && (!ok || apiErr.Code != CodeInvalidArgument) {
+			t.Errorf("ParseUserQuery(%q).Validate() returned %#v, want %s error", tt.input, err, CodeInvalidArgument)
+		}
+	}
+}
+
+func TestUserQueryReindexerDSL(t *testing.T) {
+	tests := []struct {
+		input  string
+		fields []string
+		want   string
+	}{
+		{"golang tutorial", postsQueryFields, "@* +*golang~* +*tutorial~* "},
+		{"go", postsQueryFields, ""},
+		{"go lang", postsQueryFields, "@* +go~* +*lang~* "},
+		{`"exact phrase"`, postsQueryFields, `@* +"exact phrase" `},
+		{`-"bad phrase" golang`, postsQueryFields, `@* -"bad phrase" +*golang~* `},
+		{"golang -java", postsQueryFields, "@* +*golang~* -java "},
+		{"-java", postsQueryFields, ""},
+		{"title:golang tutorial", postsQueryFields, "@title +*golang~* @* +*tutorial~* "},
+		{"title: golang tutorial", postsQueryFields, "@title +*golang~* @* +*tutorial~* "},
+		{`text:"some phrase"`, postsQueryFields, `@text +"some phrase" `},
+		{"title:golang", commentsQueryFields, "@* +*golang~* "},
+		{"golang OR rust", postsQueryFields, "@* *golang~* *rust~* "},
+		{"golang OR rust -java", postsQueryFields, "@* *golang~* *rust~* -java "},
+		{`golang OR "go lang"`, postsQueryFields, `@* *golang~* "go lang" `},
+		{`c\+\+ golang`, postsQueryFields, `@* +*c\+\+~* +*golang~* `},
+		{`\-minus`, postsQueryFields, `@* +*\-minus~* `},
+		{"OR OR golang", postsQueryFields, "@* +*golang~* "},
+		{"golang OR", postsQueryFields, "@* *golang~* "},
+		{"OR", postsQueryFields, ""},
+		{"", postsQueryFields, ""},
+	}
+	for _, tt := range tests {
+		if got := ParseUserQuery(tt.input).ReindexerDSL("*", tt.fields); got != tt.want {
+			t.Errorf("ReindexerDSL(%q) = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
@@ -1,76 +1,37 @@
+//go:build !noreindexer
+// +build !noreindexer
+
 package main
 
 // Import package
 import (
-	"bytes"
-	"encoding/json"
-	"fmt"
-	"log"
-	"os"
-	"strings"
-	"unicode"
-
-	"io/ioutil"
+	"sync"
+	"time"
 
 	"github.com/restream/reindexer"
 	_ "github.com/restream/reindexer/bindings/builtin"
 	_ "github.com/restream/reindexer/pprof"
 )
 
-type HabrComment struct {
-	ID     int      `reindex:"id,,pk" json:"id"`
-	PostID int      `reindex:"post_id,,dense" json:"post_id"`
-	Text   string   `reindex:"text,-,dense"  json:"text"`
-	User   string   `reindex:"user,-,dense" json:"user"`
-	Time   int64    `reindex:"time,-,dense" json:"time"`
-	Likes  int      `reindex:"likes,-,dense" json:"likes,omitempty"`
-	_      struct{} `reindex:"text+user=search,text,composite"`
-}
-
-type HabrPost struct {
-	ID        int      `reindex:"id,tree,pk" json:"id"`
-	Time      int64    `reindex:"time,tree,dense"  json:"time"`
-	Text      string   `reindex:"text,-"  json:"text"`
-	Title     string   `reindex:"title,-"  json:"title"`
-	User      string   `reindex:"user" json:"user"`
-	Hubs      []string `reindex:"hubs" json:"hubs"`
-	Tags      []string `reindex:"tags" json:"tags"`
-	Likes     int      `reindex:"likes,-,dense" json:"likes,omitempty"`
-	Favorites int      `reindex:"favorites,-,dense" json:"favorites,omitempty"`
-	Views     int      `reindex:"views,-,dense" json:"views"`
-	HasImage  bool     `json:"has_image,omitempty"`
-
-	Comments []*HabrComment `reindex:"comments,,joined" json:"comments,omitempty"`
-	_        struct{}       `reindex:"title+text+user=search,text,composite"`
-}
-
-type FTConfig struct {
-	Bm25Boost      float64 `json:"bm25_boost"`
-	Bm25Weight     float64 `json:"bm25_weight"`
-	DistanceBoost  float64 `json:"distance_boost"`
-	DistanceWeight float64 `json:"distance_weight"`
-	TermLenBoost   float64 `json:"term_len_boost"`
-	TermLenWeight  float64 `json:"term_len_weight"`
-	MinRelevancy   float64 `json:"min_relevancy"`
-	Fields         string  `json:"fields"`
+// ReindexerRepo is Storage implementation backed by reindexer
+type ReindexerRepo struct {
+	db  *reindexer.Reindexer
+	dsn string
+	// cfgLock guards cfg, which is changed by admin API while searches read it
+	cfgLock sync.RWMutex
+	cfg     RepoConfig
+	ready   bool
 }
 
-type RepoConfig struct {
-	PostsFt    FTConfig `json:"posts"`
-	CommentsFt FTConfig `json:"comments"`
-}
-
-type Repo struct {
-	db    *reindexer.Reindexer
-	cfg   RepoConfig
-	ready bool
+func newReindexerRepo(dsn string) (Storage, error) {
+	return &ReindexerRepo{dsn: dsn}, nil
 }
 
 func applyOffsetAndLimit(query *reindexer.Query, offset, limit int) {
 	if limit != -1 {
 		query.Limit(limit)
 	} else {
-		query.Limit(20)
+		query.Limit(defaultPageLimit)
 	}
 
 	if offset != -1 {
@@ -78,90 +39,136 @@ func applyOffsetAndLimit(query *reindexer.Query, offset, limit int) {
 	}
 }
 
-func textToReindexFullTextDSL(fields string, input string) string {
-	var output, cur bytes.Buffer
-	// Boost fields
-	if len(fields) > 0 {
-		output.WriteByte('@')
-		output.WriteString(fields)
-		output.WriteByte(' ')
+// applySort sorts by keys of order and then by id, so cursor is position in results. Results sorted only
+// by relevance are not sorted explicitly, it is default order of full text search. Without cursor total count is requested
+func applySort(query *reindexer.Query, cursor *Cursor, order SortOrder) {
+	if len(order) != 1 || order[0].Field != SortRelevance {
+		for _, k := range order {
+			switch k.Field {
+			case SortRelevance:
+				query.Sort("rank()", true)
+			case SortFresh:
+				query.Sort(freshSortExpr(time.Now().Unix()), true)
+			default:
+				query.Sort(k.Field, k.Desc)
+			}
+		}
+		query.Sort("id", false)
 	}
 
-	interm := false
-	term := 0
-	termLen := 0
-
-	// trim input spaces, and add trailing space
-	input = strings.Trim(input, " ") + " "
+	if cursor == nil {
+		query.ReqTotal()
+		return
+	}
 
-	for _, r := range input {
-		if (unicode.IsDigit(r) || unicode.IsLetter(r)) && !interm {
-			cur.Reset()
-			interm = true
-			termLen = 0
+	// (k1 > v1) OR (k1 = v1 AND k2 > v2) OR ... OR (k1 = v1 AND ... AND id > ID)
+	query.OpenBracket()
+	for i := 0; i <= len(order); i++ {
+		if i > 0 {
+			query.Or()
 		}
-
-		if !unicode.IsDigit(r) && !unicode.IsLetter(r) && !strings.Contains("-+/", string(r)) && interm {
-
-			if term > 0 {
-				output.WriteByte('+')
-			}
-			switch {
-			case termLen >= 3:
-				// enable typos search from 3 symbols in term
-				output.WriteString("*")
-				output.Write(cur.Bytes())
-				output.WriteString("~*")
-			case termLen >= 2:
-				// enable prefix from 2 symbol or on 2-nd+ term
-				output.Write(cur.Bytes())
-				output.WriteString("~*")
-			default:
-				output.Write(cur.Bytes())
-			}
-			output.WriteByte(' ')
-			interm = false
-			term++
-			if term > 8 {
-				break
-			}
+		query.OpenBracket()
+		for j := 0; j < i; j++ {
+			query.WhereInt64(order[j].Field, reindexer.EQ, cursor.Values[j])
 		}
-		if interm {
-			cur.WriteRune(r)
-			termLen++
+		if i == len(order) {
+			query.WhereInt("id", reindexer.GT, cursor.ID)
+		} else if order[i].Desc {
+			query.WhereInt64(order[i].Field, reindexer.LT, cursor.Values[i])
+		} else {
+			query.WhereInt64(order[i].Field, reindexer.GT, cursor.Values[i])
 		}
+		query.CloseBracket()
 	}
+	query.CloseBracket()
+}
 
-	if termLen <= 2 && term == 1 {
-		return ""
+func applyPostsFilter(query *reindexer.Query, filter PostsFilter) {
+	if len(filter.Hubs) > 0 {
+		query.WhereString("hubs", reindexer.SET, filter.Hubs...)
+	}
+
+	if len(filter.Tags) > 0 {
+		query.WhereString("tags", reindexer.SET, filter.Tags...)
+	}
+
+	if len(filter.User) > 0 {
+		query.WhereString("user", reindexer.EQ, filter.User)
+	}
+
+	if filter.StartTime != -1 {
+		query.WhereInt("time", reindexer.GE, filter.StartTime)
+	}
+
+	if filter.EndTime != -1 {
+		query.WhereInt("time", reindexer.LE, filter.EndTime)
 	}
 
-	return output.String()
+	if filter.MinLikes != -1 {
+		query.WhereInt("likes", reindexer.GE, filter.MinLikes)
+	}
+
+	if filter.MinViews != -1 {
+		query.WhereInt("views", reindexer.GE, filter.MinViews)
+	}
+}
+
+func applyFacets(query *reindexer.Query, facets []string) {
+	for _, field := range facets {
+		query.AggregateFacet(field).Sort("count", true).Limit(maxFacetValues)
+	}
+}
+
+func aggResultsToFacets(results []reindexer.AggregationResult) Facets {
+	if len(results) == 0 {
+		return nil
+	}
+	facets := make(Facets, len(results))
+	for _, res := range results {
+		if len(res.Fields) != 1 {
+			continue
+		}
+		values := make([]FacetValue, 0, len(res.Facets))
+		for _, f := range res.Facets {
+			if len(f.Values) == 1 {
+				values = append(values, FacetValue{Value: f.Values[0], Count: f.Count})
+			}
+		}
+		facets[res.Fields[0]] = values
+	}
+	return facets
+}
+
+// textToReindexFullTextDSL parses user query and compiles it to reindexer full text DSL.
+// fields are boosted fields for terms without prefix, and nsFields are fields, which can be used as prefixes
+func textToReindexFullTextDSL(fields string, nsFields []string, input string) string {
+	return ParseUserQuery(input).ReindexerDSL(fields, nsFields)
 }
 
-func (r *Repo) SearchPosts(text string, offset, limit int, sortBy string, sortDesc bool) ([]*HabrPost, int, error) {
+func (r *ReindexerRepo) SearchPosts(text string, filter PostsFilter, facets []string, offset, limit int, cursor *Cursor, order SortOrder) ([]*HabrPost, Facets, int, error) {
 
 	if !r.ready {
-		return nil, 0, fmt.Errorf("repo is not ready")
+		return nil, nil, 0, ErrNotReady
 	}
 
-	query := repo.db.Query("posts").
-		Match("search", textToReindexFullTextDSL(r.cfg.PostsFt.Fields, text)).
-		ReqTotal()
+	query := r.db.Query("posts").
+		Match("search", textToReindexFullTextDSL(r.ftFields("posts"), postsQueryFields, text))
+
+	applyPostsFilter(query, filter)
 
 	query.Functions("text = snippet(<b>,</b>,30,30, ...,... <br/>)")
 
-	if len(sortBy) != 0 {
-		query.Sort(sortBy, sortDesc)
-	}
+	applySort(query, cursor, order)
 
 	applyOffsetAndLimit(query, offset, limit)
 
+	applyFacets(query, facets)
+
 	it := query.Exec()
 	defer it.Close()
 
 	if err := it.Error(); err != nil {
-		return nil, 0, err
+		return nil, nil, 0, err
 	}
 
 	items := make([]*HabrPost, 0, it.Count())
@@ -170,61 +177,152 @@ func (r *Repo) SearchPosts(text string, offset, limit int, sortBy string, sortDe
 		items = append(items, item.(*HabrPost))
 	}
 
-	return items, it.TotalCount(), nil
+	return items, aggResultsToFacets(it.AggResults()), it.TotalCount(), nil
 }
 
-func (r *Repo) GetPost(id int, withComments bool) (*HabrPost, error) {
+func (r *ReindexerRepo) GetPost(id int, withComments bool) (*HabrPost, error) {
 	if !r.ready {
-		return nil, fmt.Errorf("repo is not ready")
+		return nil, ErrNotReady
 	}
 
-	query := repo.db.Query("posts").
+	query := r.db.Query("posts").
 		WhereInt("id", reindexer.EQ, id).
 		ReqTotal()
 
 	if withComments {
-		query.Join(repo.db.Query("comments"), "comments").On("id", reindexer.EQ, "post_id")
+		query.Join(r.db.Query("comments"), "comments").On("id", reindexer.EQ, "post_id")
 	}
 
 	it := query.Exec()
 	defer it.Close()
 
-	obj, err := it.FetchOne()
-
-	if err != nil {
+	if err := it.Error(); err != nil {
 		return nil, err
 	}
+	if !it.Next() {
+		return nil, NotFoundError("Post %d not found", id)
+	}
 
-	return obj.(*HabrPost), nil
+	return it.Object().(*HabrPost), nil
 }
 
-func (r *Repo) GetPosts(offset int, limit int, user string, startTime int, endTime int, withComments bool) ([]*HabrPost, int, error) {
+func (r *ReindexerRepo) GetPosts(filter PostsFilter, facets []string, offset int, limit int, cursor *Cursor, order SortOrder, withComments bool) ([]*HabrPost, Facets, int, error) {
 	if !r.ready {
-		return nil, 0, fmt.Errorf("repo is not ready")
+		return nil, nil, 0, ErrNotReady
 	}
 
-	query := repo.db.Query("posts").
-		ReqTotal()
+	query := r.db.Query("posts")
 
 	applyOffsetAndLimit(query, offset, limit)
+	applyPostsFilter(query, filter)
+
+	if withComments {
+		query.Join(r.db.Query("comments"), "comments").On("id", reindexer.EQ, "post_id")
+	}
+
+	applySort(query, cursor, order)
+
+	applyFacets(query, facets)
+
+	it := query.Exec()
+	defer it.Close()
 
-	if startTime != -1 {
-		query.WhereInt("time", reindexer.GE, startTime)
+	if err := it.Error(); err != nil {
+		return nil, nil, 0, err
 	}
 
-	if endTime != -1 {
-		query.WhereInt("time", reindexer.LE, endTime)
+	items := make([]*HabrPost, 0, it.Count())
+	for it.Next() {
+		item := it.Object()
+		items = append(items, item.(*HabrPost))
 	}
 
-	if len(user) > 0 {
-		query.WhereString("user", reindexer.EQ, user)
+	return items, aggResultsToFacets(it.AggResults()), it.TotalCount(), nil
+}
+
+func (r *ReindexerRepo) GetComments(postID int) ([]*HabrComment, error) {
+	if !r.ready {
+		return nil, ErrNotReady
 	}
 
-	if withComments {
-		query.Join(repo.db.Query("comments"), "comments").On("id", reindexer.EQ, "post_id")
+	it := r.db.Query("comments").
+		WhereInt("post_id", reindexer.EQ, postID).
+		Sort("id", false).
+		Exec()
+	defer it.Close()
+
+	if err := it.Error(); err != nil {
+		return nil, err
 	}
 
-	query.Sort("time", false)
+	items := make([]*HabrComment, 0, it.Count())
+	for it.Next() {
+		item := it.Object()
+		items = append(items, item.(*HabrComment))
+	}
+
+	return items, nil
+}
+
+func (r *ReindexerRepo) MaxPostID() (int, error) {
+	if !r.ready {
+		return 0, ErrNotReady
+	}
+
+	it := r.db.Query("posts").
+		Sort("id", true).
+		Limit(1).
+		Exec()
+	defer it.Close()
+
+	obj, err := it.FetchOne()
+	if err != nil {
+		return 0, err
+	}
+
+	return obj.(*HabrPost).ID, nil
+}
+
+func (r *ReindexerRepo) Stats() (RepoStats, error) {
+	stats := RepoStats{Ready: r.ready}
+	if r.db == nil {
+		return stats, nil
+	}
+
+	for _, ns := range []struct {
+		name  string
+		count *int
+	}{{"posts", &stats.Posts}, {"comments", &stats.Comments}, {"code", &stats.Code}, {"users", &stats.Users}} {
+		it := r.db.Query(ns.name).Limit(0).ReqTotal().Exec()
+		if err := it.Error(); err != nil {
+			it.Close()
+			return stats, err
+		}
+		*ns.count = it.TotalCount()
+		it.Close()
+	}
+
+	it := r.db.Query("posts").Sort("time", true).Limit(1).Exec()
+	defer it.Close()
+	if obj, err := it.FetchOne(); err == nil {
+		stats.LastPostTime = obj.(*HabrPost).Time
+	}
+	return stats, nil
+}
+
+func (r *ReindexerRepo) SearchComments(text string, offset, limit int, cursor *Cursor, order SortOrder) ([]*HabrComment, int, error) {
+	if !r.ready {
+		return nil, 0, ErrNotReady
+	}
+
+	query := r.db.Query("comments").
+		Match("search", textToReindexFullTextDSL(r.ftFields("comments"), commentsQueryFields, text))
+
+	query.Functions("text = snippet(<b>,</b>,30,30, ...,... <br/>)")
+
+	applySort(query, cursor, order)
+
+	applyOffsetAndLimit(query, offset, limit)
 
 	it := query.Exec()
 	defer it.Close()
@@ -233,28 +331,31 @@ func (r *Repo) GetPosts(offset int, limit int, user string, startTime int, endTi
 		return nil, 0, err
 	}
 
-	items := make([]*HabrPost, 0, it.Count())
+	items := make([]*HabrComment, 0, it.Count())
 	for it.Next() {
 		item := it.Object()
-		items = append(items, item.(*HabrPost))
+		items = append(items, item.(*HabrComment))
 	}
 
 	return items, it.TotalCount(), nil
 }
 
-func (r *Repo) SearchComments(text string, offset, limit int, sortBy string, sortDesc bool) ([]*HabrComment, int, error) {
+func (r *ReindexerRepo) SearchCode(text string, lang string, offset, limit int) ([]*HabrCode, int, error) {
 	if !r.ready {
-		return nil, 0, fmt.Errorf("repo is not ready")
+		return nil, 0, ErrNotReady
 	}
 
-	query := repo.db.Query("comments").
-		ReqTotal().
-		Match("search", textToReindexFullTextDSL(r.cfg.CommentsFt.Fields, text))
+	dsl := codeDSL(text)
+	if len(dsl) == 0 {
+		return []*HabrCode{}, 0, nil
+	}
 
-	query.Functions("text = snippet(<b>,</b>,30,30, ...,... <br/>)")
+	query := r.db.Query("code").
+		ReqTotal().
+		Match("tokens", dsl)
 
-	if len(sortBy) != 0 {
-		query.Sort(sortBy, sortDesc)
+	if len(lang) != 0 {
+		query.WhereString("lang", reindexer.EQ, lang)
 	}
 
 	applyOffsetAndLimit(query, offset, limit)
@@ -266,70 +367,190 @@ func (r *Repo) SearchComments(text string, offset, limit int, sortBy string, sor
 		return nil, 0, err
 	}
 
-	items := make([]*HabrComment, 0, it.Count())
+	items := make([]*HabrCode, 0, it.Count())
 	for it.Next() {
 		item := it.Object()
-		items = append(items, item.(*HabrComment))
+		items = append(items, item.(*HabrCode))
 	}
 
 	return items, it.TotalCount(), nil
 }
 
-func (r *Repo) updatePostFromFile(filePath string) {
-	jsonItem, err := ioutil.ReadFile(filePath)
-	if err != nil {
-		log.Printf("Error read file %s: %s\n", filePath, err.Error())
+func (r *ReindexerRepo) GetUsers(nicks []string, offset, limit int, cursor *Cursor, order SortOrder) ([]*HabrUser, int, error) {
+	if !r.ready {
+		return nil, 0, ErrNotReady
 	}
-	post := HabrPost{}
-	err = json.Unmarshal(jsonItem, &post)
-	if err != nil {
-		log.Printf("Error parse file %s: %s\n", filePath, err.Error())
+
+	query := r.db.Query("users")
+	if len(nicks) != 0 {
+		query.WhereString("nick", reindexer.SET, nicks...)
 	}
 
-	for _, comment := range post.Comments {
-		comment.PostID = post.ID
-		err = r.db.Upsert("comments", comment)
-		if err != nil {
-			log.Printf("Error upsert comment %d from file %s: %s\n", comment.ID, filePath, err.Error())
-		}
+	applySort(query, cursor, order)
+	applyOffsetAndLimit(query, offset, limit)
+
+	it := query.Exec()
+	defer it.Close()
+
+	if err := it.Error(); err != nil {
+		return nil, 0, err
 	}
 
-	post.Comments = post.Comments[:0]
-	err = r.db.Upsert("posts", post)
-	if err != nil {
-		log.Printf("Error upsert post from file %s: %s\n", filePath, err.Error())
+	items := make([]*HabrUser, 0, it.Count())
+	for it.Next() {
+		items = append(items, it.Object().(*HabrUser))
 	}
 
+	return items, it.TotalCount(), nil
 }
 
-func (r *Repo) RestoreAllFromFiles(path string) {
-	files, err := ioutil.ReadDir(path)
+func (r *ReindexerRepo) GetUser(nick string) (*HabrUser, error) {
+	if !r.ready {
+		return nil, ErrNotReady
+	}
+
+	it := r.db.Query("users").
+		WhereString("nick", reindexer.EQ, nick).
+		Exec()
+	defer it.Close()
+
+	if err := it.Error(); err != nil {
+		return nil, err
+	}
+	if !it.Next() {
+		return nil, NotFoundError("User %s not found", nick)
+	}
+
+	return it.Object().(*HabrUser), nil
+}
+
+// userIDs returns IDs of all stored users by nick and the greatest ID
+func (r *ReindexerRepo) userIDs() (map[string]int, int, error) {
+	it := r.db.Query("users").Exec()
+	defer it.Close()
+
+	if err := it.Error(); err != nil {
+		return nil, 0, err
+	}
+
+	ids := make(map[string]int, it.Count())
+	maxID := 0
+	for it.Next() {
+		u := it.Object().(*HabrUser)
+		ids[u.Nick] = u.ID
+		if u.ID > maxID {
+			maxID = u.ID
+		}
+	}
+	return ids, maxID, nil
+}
+
+func (r *ReindexerRepo) UpsertUsers(users []*HabrUser) error {
+	ids, maxID, err := r.userIDs()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	for i, f := range files {
-		r.updatePostFromFile(path + "/" + f.Name())
-		if (i != 0 && (i%1000) == 0) || i == len(files)-1 {
-			fmt.Printf("processed %d files (from %d)\n", i+1, len(files))
+	for _, user := range users {
+		u := *user
+		if id, ok := ids[u.Nick]; ok {
+			u.ID = id
+		} else {
+			maxID++
+			u.ID = maxID
+			ids[u.Nick] = u.ID
+		}
+		if err = r.db.Upsert("users", &u); err != nil {
+			return err
 		}
 	}
+	repoLog.Infof("%d users are aggregated", len(users))
+	return nil
+}
+
+func (r *ReindexerRepo) DeleteUsers(nicks []string) error {
+	if len(nicks) == 0 {
+		return nil
+	}
+	if _, err := r.db.Query("users").WhereString("nick", reindexer.SET, nicks...).Delete(); err != nil {
+		return err
+	}
+	repoLog.Infof("%d users are deleted", len(nicks))
+	return nil
 }
 
-func (r *Repo) RestoreRangeFromFiles(path string, startID, finishID int) {
+func (r *ReindexerRepo) GetUsersPosts(nicks []string) ([]*HabrPost, error) {
+	if !r.ready {
+		return nil, ErrNotReady
+	}
+	if len(nicks) == 0 {
+		return []*HabrPost{}, nil
+	}
 
-	cnt := 0
-	for id := startID; id < finishID; id++ {
-		fileName := fmt.Sprintf("%s/%d.json", path, id)
-		if _, err := os.Stat(fileName); err == nil {
-			r.updatePostFromFile(fileName)
-			cnt++
+	it := r.db.Query("comments").WhereString("user", reindexer.SET, nicks...).Exec()
+	defer it.Close()
+	if err := it.Error(); err != nil {
+		return nil, err
+	}
+	ids := make([]int, 0, it.Count())
+	for it.Next() {
+		ids = append(ids, it.Object().(*HabrComment).PostID)
+	}
+
+	query := r.db.Query("posts").WhereString("user", reindexer.SET, nicks...)
+	if len(ids) != 0 {
+		query.Or().WhereInt("id", reindexer.SET, ids...)
+	}
+	query.Join(r.db.Query("comments"), "comments").On("id", reindexer.EQ, "post_id")
+
+	pit := query.Exec()
+	defer pit.Close()
+	if err := pit.Error(); err != nil {
+		return nil, err
+	}
+
+	posts := make([]*HabrPost, 0, pit.Count())
+	for pit.Next() {
+		posts = append(posts, pit.Object().(*HabrPost))
+	}
+	return posts, nil
+}
+
+func (r *ReindexerRepo) UpsertPost(post *HabrPost) error {
+	for _, comment := range post.Comments {
+		comment.PostID = post.ID
+		if err := r.db.Upsert("comments", comment); err != nil {
+			repoLog.Errorf("Error upsert comment %d of post %d: %s", comment.ID, post.ID, err.Error())
 		}
 	}
-	fmt.Printf("processed %d files\n", cnt+1)
+
+	if _, err := r.db.Query("code").WhereInt("post_id", reindexer.EQ, post.ID).Delete(); err != nil {
+		repoLog.Errorf("Error delete code of post %d: %s", post.ID, err.Error())
+	}
+	for _, code := range post.Code {
+		code.PostID = post.ID
+		code.Tokens = codeTokens(code.Code)
+		if err := r.db.Upsert("code", code); err != nil {
+			repoLog.Errorf("Error upsert code %d of post %d: %s", code.ID, post.ID, err.Error())
+		}
+	}
+
+	item := *post
+	item.Comments = nil
+	item.Code = nil
+	return r.db.Upsert("posts", item)
 }
 
-func (r *Repo) setFTConfig(ns string, newCfg FTConfig) error {
+func (r *ReindexerRepo) RestoreAllFromFiles(path string) {
+	restoreAllFromFiles(r, path)
+}
+
+func (r *ReindexerRepo) RestoreRangeFromFiles(path string, startID, finishID int) {
+	restoreRangeFromFiles(r, path, startID, finishID)
+}
+
+// setFTConfig configures full text index of namespace. cfgLock must be locked by caller
+func (r *ReindexerRepo) setFTConfig(ns string, newCfg FTConfig) error {
 
 	cfg := reindexer.DefaultFtFastConfig()
 	cfg.MaxTyposInWord = 1
@@ -338,6 +559,8 @@ func (r *Repo) setFTConfig(ns string, newCfg FTConfig) error {
 	cfg.Bm25Weight = newCfg.Bm25Weight
 	cfg.DistanceBoost = newCfg.DistanceBoost
 	cfg.DistanceWeight = newCfg.DistanceWeight
+	cfg.TermLenBoost = newCfg.TermLenBoost
+	cfg.TermLenWeight = newCfg.TermLenWeight
 	cfg.MinRelevancy = newCfg.MinRelevancy
 
 	err := r.db.ConfigureIndex(ns, "search", cfg)
@@ -346,61 +569,57 @@ func (r *Repo) setFTConfig(ns string, newCfg FTConfig) error {
 		return err
 	}
 
-	switch ns {
-	case "posts":
-		r.cfg.PostsFt = newCfg
-	case "comments":
-		r.cfg.CommentsFt = newCfg
-	default:
-		return fmt.Errorf("Unknown namespace %s", ns)
+	ftCfg, err := r.cfg.ftConfig(ns)
+	if err != nil {
+		return err
 	}
+	*ftCfg = newCfg
 	return nil
 }
 
-func (r *Repo) SetFTConfig(ns string, newCfg FTConfig) error {
-	err := r.setFTConfig(ns, newCfg)
+// ftFields returns boosted fields of full text search of namespace
+func (r *ReindexerRepo) ftFields(ns string) string {
+	cfg, err := r.GetFTConfig(ns)
 	if err != nil {
-		return err
-	}
-	data, err := json.Marshal(r.cfg)
-	if err != nil {
-		return err
+		return ""
 	}
-	return ioutil.WriteFile("repo.cfg", data, 0666)
+	return cfg.Fields
 }
 
-func (r *Repo) Init() {
+func (r *ReindexerRepo) GetFTConfig(ns string) (FTConfig, error) {
+	r.cfgLock.RLock()
+	defer r.cfgLock.RUnlock()
 
-	if r.db == nil {
-		r.db = reindexer.NewReindex("builtin:///var/lib/reindexer/habr")
-		r.db.SetLogger(logger)
+	cfg, err := r.cfg.ftConfig(ns)
+	if err != nil {
+		return FTConfig{}, err
 	}
-	cfgFile, err := ioutil.ReadFile("repo.cfg")
-	newCfg := RepoConfig{}
+	return *cfg, nil
+}
 
+func (r *ReindexerRepo) SetFTConfig(ns string, newCfg FTConfig) (FTConfig, error) {
+	r.cfgLock.Lock()
+	defer r.cfgLock.Unlock()
+
+	cfg, err := r.cfg.ftConfig(ns)
 	if err != nil {
-		err = json.Unmarshal(cfgFile, &newCfg)
+		return FTConfig{}, err
+	}
+	prevCfg := *cfg
+	if err = r.setFTConfig(ns, newCfg); err != nil {
+		return FTConfig{}, err
 	}
+	return prevCfg, saveRepoConfig(repoConfigPath(), r.cfg)
+}
 
-	if err != nil {
+func (r *ReindexerRepo) Init() {
 
-		newCfg.PostsFt = FTConfig{
-			Bm25Boost:      0.1,
-			Bm25Weight:     0.3,
-			DistanceBoost:  2.0,
-			DistanceWeight: 0.5,
-			MinRelevancy:   0.2,
-			Fields:         "*^0.4,user^1.0,title^1.6",
-		}
-		newCfg.CommentsFt = FTConfig{
-			Bm25Boost:      0.1,
-			Bm25Weight:     0.3,
-			DistanceBoost:  2.0,
-			DistanceWeight: 0.5,
-			MinRelevancy:   0.2,
-			Fields:         "",
-		}
+	if r.db == nil {
+		r.db = reindexer.NewReindex(r.dsn)
+		r.db.SetLogger(&reindexerLogAdapter{})
 	}
+	newCfg := loadRepoConfig(repoConfigPath())
+	var err error
 	// cfg.StopWords = []string{"делать", "работать", "например", "получить", "данные", "стоит", "имеет", "компании", "случае", "код", "образом", "возможность", "работает", "свой", "т", "данных",
 	// 	"сделать", "0", "позволяет", "помощью", "сразу", "4", "3", "6", "момент", "таким", "работы", "2", "использовать",
 	// 	"с", "достаточно", "является", "часть", "10", "поэтому", "количество"}
@@ -408,46 +627,76 @@ func (r *Repo) Init() {
 	if err = r.db.OpenNamespace("comments", reindexer.DefaultNamespaceOptions(), HabrComment{}); err != nil {
 		panic(err)
 	}
-	if err = r.setFTConfig("comments", newCfg.CommentsFt); err != nil {
+	if err = r.db.OpenNamespace("posts", reindexer.DefaultNamespaceOptions(), HabrPost{}); err != nil {
+		panic(err)
+	}
+	r.cfgLock.Lock()
+	if err = r.setFTConfig("comments", newCfg.CommentsFt); err == nil {
+		err = r.setFTConfig("posts", newCfg.PostsFt)
+	}
+	r.cfgLock.Unlock()
+	if err != nil {
 		panic(err)
 	}
 
-	if err = r.db.OpenNamespace("posts", reindexer.DefaultNamespaceOptions(), HabrPost{}); err != nil {
+	if err = r.db.OpenNamespace("code", reindexer.DefaultNamespaceOptions(), HabrCode{}); err != nil {
+		panic(err)
+	}
+	// Tokens of code are lowercased identifiers, so they must not be stemmed or corrected
+	codeCfg := reindexer.DefaultFtFastConfig()
+	codeCfg.MaxTyposInWord = 0
+	codeCfg.Stemmers = []string{}
+	codeCfg.LogLevel = reindexer.INFO
+	if err = r.db.ConfigureIndex("code", "tokens", codeCfg); err != nil {
 		panic(err)
 	}
-	if err = r.setFTConfig("posts", newCfg.PostsFt); err != nil {
+
+	if err = r.db.OpenNamespace("users", reindexer.DefaultNamespaceOptions(), HabrUser{}); err != nil {
 		panic(err)
 	}
-	repo.WarmUp()
+	r.WarmUp()
 }
 
-func (r *Repo) WarmUp() {
+func (r *ReindexerRepo) WarmUp() {
 	it := r.db.Query("comments").Where("search", reindexer.EQ, "").Exec()
 	if it.Error() != nil {
-		log.Print(it.Error().Error())
+		repoLog.Errorf("%s", it.Error().Error())
 	}
 	it.Close()
 	it = r.db.Query("posts").Where("search", reindexer.EQ, "").Exec()
 	if it.Error() != nil {
-		log.Print(it.Error().Error())
+		repoLog.Errorf("%s", it.Error().Error())
+	}
+	it.Close()
+	it = r.db.Query("code").Where("tokens", reindexer.EQ, "").Exec()
+	if it.Error() != nil {
+		repoLog.Errorf("%s", it.Error().Error())
 	}
 	r.ready = true
 	it.Close()
 }
 
-func (r *Repo) Done() {
+func (r *ReindexerRepo) Done() {
 	r.ready = false
 	r.db.CloseNamespace("posts")
 	r.db.CloseNamespace("comments")
+	r.db.CloseNamespace("code")
+	r.db.CloseNamespace("users")
 }
 
-type Logger struct {
+// reindexerLogAdapter passes reindexer log messages to repo logger with corresponding levels
+type reindexerLogAdapter struct {
 }
 
-func (l *Logger) Printf(level int, format string, msg ...interface{}) {
-	if level <= reindexer.TRACE {
-		log.Printf(format, msg...)
+func (l *reindexerLogAdapter) Printf(level int, format string, msg ...interface{}) {
+	switch level {
+	case reindexer.ERROR:
+		repoLog.Errorf(format, msg...)
+	case reindexer.WARNING:
+		repoLog.Warnf(format, msg...)
+	case reindexer.INFO:
+		repoLog.Infof(format, msg...)
+	default:
+		repoLog.Debugf(format, msg...)
 	}
 }
-
-var logger = &Logger{}
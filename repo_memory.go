@@ -0,0 +1,772 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryRepo is pure Go Storage implementation. It keeps all data in maps and
+// does naive full text search, so it is suitable for tests and small datasets
+type MemoryRepo struct {
+	lock     sync.RWMutex
+	posts    map[int]*HabrPost
+	comments map[int]*HabrComment
+	byPost   map[int][]int
+	code     map[int]*HabrCode
+	codeOf   map[int][]int
+	users    map[int]*HabrUser
+	cfg      RepoConfig
+	dumpPath string
+	ready    bool
+}
+
+func NewMemoryRepo(dumpPath string) *MemoryRepo {
+	return &MemoryRepo{dumpPath: dumpPath}
+}
+
+type memMatch struct {
+	id   int
+	rank float64
+	keys []float64
+}
+
+// memField is named text field with rank weight
+type memField struct {
+	name   string
+	text   string
+	weight float64
+}
+
+// memWeights returns weights of fields from boosted fields of full text config, e.g. "*^0.4,title^1.6".
+// Not listed fields have weight of "*", or are not searched, if "*" is not listed. All fields have weight 1,
+// if config has no fields
+func memWeights(boosted string) func(field string) float64 {
+	if len(strings.TrimSpace(boosted)) == 0 {
+		return func(string) float64 { return 1.0 }
+	}
+	weights := make(map[string]float64)
+	for _, field := range strings.Split(boosted, ",") {
+		parts := strings.SplitN(field, "^", 2)
+		weight := 1.0
+		if len(parts) == 2 {
+			if w, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64); err == nil {
+				weight = w
+			}
+		}
+		weights[strings.TrimSpace(parts[0])] = weight
+	}
+	return func(field string) float64 {
+		if w, ok := weights[field]; ok {
+			return w
+		}
+		return weights["*"]
+	}
+}
+
+// memRank returns weighted count of query terms found in fields, or 0 if document does not match query.
+// It mimics reindexer: all required terms must be found, excluded terms must not be found, and optional
+// terms must be found only if query has no required terms
+func memRank(q UserQuery, fields []memField) float64 {
+	if q.IsEmpty() {
+		return 0
+	}
+
+	rank := 0.0
+	hasRequired, optionalFound := false, false
+	for _, t := range q.Terms {
+		needle := strings.ToLower(strings.Join(t.Words, " "))
+		hasField := false
+		for _, f := range fields {
+			hasField = hasField || f.name == t.Field
+		}
+
+		termRank := 0.0
+		for _, f := range fields {
+			if hasField && f.name != t.Field {
+				continue
+			}
+			termRank += float64(strings.Count(f.text, needle)) * f.weight
+		}
+
+		switch {
+		case t.Exclude:
+			if termRank > 0 {
+				return 0
+			}
+		case t.Optional:
+			optionalFound = optionalFound || termRank > 0
+		default:
+			hasRequired = true
+			if termRank == 0 {
+				return 0
+			}
+		}
+		rank += termRank
+	}
+
+	if !hasRequired && !optionalFound {
+		return 0
+	}
+	return rank
+}
+
+// memSnippet mimics reindexer snippet(<b>,</b>,30,30, ...,... <br/>) function
+func memSnippet(text string, terms []string) string {
+	lower := strings.ToLower(text)
+	var out []string
+	for _, term := range terms {
+		pos := strings.Index(lower, term)
+		if pos < 0 || pos+len(term) > len(text) {
+			continue
+		}
+		start, end := pos-30, pos+len(term)+30
+		if start < 0 {
+			start = 0
+		}
+		if end > len(text) {
+			end = len(text)
+		}
+		// Do not cut utf-8 sequences
+		for start > 0 && !isRuneStart(text[start]) {
+			start--
+		}
+		for end < len(text) && !isRuneStart(text[end]) {
+			end++
+		}
+		out = append(out, "..."+text[start:pos]+"<b>"+text[pos:pos+len(term)]+"</b>"+text[pos+len(term):end]+"...")
+	}
+	return strings.Join(out, " <br/>")
+}
+
+func isRuneStart(b byte) bool {
+	return b&0xC0 != 0x80
+}
+
+func containsAnyFold(values []string, wanted []string) bool {
+	for _, v := range values {
+		for _, w := range wanted {
+			if strings.EqualFold(v, w) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func matchPostsFilter(p *HabrPost, filter PostsFilter) bool {
+	switch {
+	case len(filter.Hubs) > 0 && !containsAnyFold(p.Hubs, filter.Hubs):
+		return false
+	case len(filter.Tags) > 0 && !containsAnyFold(p.Tags, filter.Tags):
+		return false
+	case len(filter.User) > 0 && p.User != filter.User:
+		return false
+	case filter.StartTime != -1 && p.Time < int64(filter.StartTime):
+		return false
+	case filter.EndTime != -1 && p.Time > int64(filter.EndTime):
+		return false
+	case filter.MinLikes != -1 && p.Likes < filter.MinLikes:
+		return false
+	case filter.MinViews != -1 && p.Views < filter.MinViews:
+		return false
+	}
+	return true
+}
+
+// memFacets counts facet fields values over all found posts
+func memFacets(posts []*HabrPost, facets []string) Facets {
+	if len(facets) == 0 {
+		return nil
+	}
+	out := make(Facets, len(facets))
+	for _, field := range facets {
+		counts := make(map[string]int)
+		for _, p := range posts {
+			switch field {
+			case "hubs":
+				for _, hub := range p.Hubs {
+					counts[hub]++
+				}
+			case "tags":
+				for _, tag := range p.Tags {
+					counts[tag]++
+				}
+			case "user":
+				counts[p.User]++
+			}
+		}
+		values := make([]FacetValue, 0, len(counts))
+		for value, count := range counts {
+			values = append(values, FacetValue{Value: value, Count: count})
+		}
+		sort.Slice(values, func(i, j int) bool {
+			if values[i].Count == values[j].Count {
+				return values[i].Value < values[j].Value
+			}
+			return values[i].Count > values[j].Count
+		})
+		if len(values) > maxFacetValues {
+			values = values[:maxFacetValues]
+		}
+		out[field] = values
+	}
+	return out
+}
+
+func memOffsetAndLimit(total, offset, limit int) (int, int) {
+	if limit == -1 {
+		limit = defaultPageLimit
+	}
+	if offset == -1 {
+		offset = 0
+	}
+	if offset > total {
+		offset = total
+	}
+	if offset+limit > total {
+		limit = total - offset
+	}
+	return offset, offset + limit
+}
+
+// sortMatches sorts matches by keys of order and then by id. Rank is normalized to percents of the best match,
+// like reindexer rank, to blend it with recency. Values of field keys and publication time are returned by item
+func sortMatches(matches []memMatch, order SortOrder, item func(id int) ([]int64, int64)) {
+	maxRank := 0.0
+	for _, m := range matches {
+		maxRank = math.Max(maxRank, m.rank)
+	}
+	now := time.Now().Unix()
+
+	for i := range matches {
+		m := &matches[i]
+		values, published := item(m.id)
+		rank := 0.0
+		if maxRank > 0 {
+			rank = m.rank * 100 / maxRank
+		}
+		m.keys = int64sToFloats(values)
+		for j, k := range order {
+			switch k.Field {
+			case SortRelevance:
+				m.keys[j] = rank
+			case SortFresh:
+				m.keys[j] = freshRank(rank, published, now)
+			}
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		return compareSortValues(order, matches[i].keys, matches[i].id, matches[j].keys, matches[j].id) < 0
+	})
+}
+
+// matchesAfter returns matches placed after cursor. Matches must be sorted by sortMatches
+func matchesAfter(matches []memMatch, cursor *Cursor, order SortOrder) []memMatch {
+	if cursor == nil {
+		return matches
+	}
+	values := int64sToFloats(cursor.Values)
+	i := sort.Search(len(matches), func(i int) bool {
+		return compareSortValues(order, values, cursor.ID, matches[i].keys, matches[i].id) < 0
+	})
+	return matches[i:]
+}
+
+func (r *MemoryRepo) postComments(id int) []*HabrComment {
+	ids := r.byPost[id]
+	out := make([]*HabrComment, 0, len(ids))
+	for _, cid := range ids {
+		c := *r.comments[cid]
+		out = append(out, &c)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+func (r *MemoryRepo) SearchPosts(text string, filter PostsFilter, facets []string, offset, limit int, cursor *Cursor, order SortOrder) ([]*HabrPost, Facets, int, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	if !r.ready {
+		return nil, nil, 0, ErrNotReady
+	}
+
+	q := ParseUserQuery(text)
+	if q.IsEmpty() {
+		return []*HabrPost{}, memFacets(nil, facets), 0, nil
+	}
+	terms := q.Words()
+
+	weight := memWeights(r.cfg.PostsFt.Fields)
+	matches := make([]memMatch, 0)
+	for id, p := range r.posts {
+		if !matchPostsFilter(p, filter) {
+			continue
+		}
+		fields := []memField{
+			{"text", strings.ToLower(p.Text), weight("text")},
+			{"user", strings.ToLower(p.User), weight("user")},
+			{"title", strings.ToLower(p.Title), weight("title")},
+		}
+		if rank := memRank(q, fields); rank > 0 {
+			matches = append(matches, memMatch{id: id, rank: rank})
+		}
+	}
+
+	sortMatches(matches, order, func(id int) ([]int64, int64) {
+		return postSortValues(r.posts[id], order), r.posts[id].Time
+	})
+
+	found := make([]*HabrPost, 0, len(matches))
+	for _, m := range matches {
+		found = append(found, r.posts[m.id])
+	}
+
+	total := len(matches)
+	matches = matchesAfter(matches, cursor, order)
+	from, to := memOffsetAndLimit(len(matches), offset, limit)
+	items := make([]*HabrPost, 0, to-from)
+	for _, m := range matches[from:to] {
+		p := *r.posts[m.id]
+		p.Text = memSnippet(p.Text, terms)
+		items = append(items, &p)
+	}
+
+	return items, memFacets(found, facets), total, nil
+}
+
+func (r *MemoryRepo) SearchComments(text string, offset, limit int, cursor *Cursor, order SortOrder) ([]*HabrComment, int, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	if !r.ready {
+		return nil, 0, ErrNotReady
+	}
+
+	q := ParseUserQuery(text)
+	if q.IsEmpty() {
+		return []*HabrComment{}, 0, nil
+	}
+	terms := q.Words()
+
+	weight := memWeights(r.cfg.CommentsFt.Fields)
+	matches := make([]memMatch, 0)
+	for id, c := range r.comments {
+		fields := []memField{
+			{"text", strings.ToLower(c.Text), weight("text")},
+			{"user", strings.ToLower(c.User), weight("user")},
+		}
+		if rank := memRank(q, fields); rank > 0 {
+			matches = append(matches, memMatch{id: id, rank: rank})
+		}
+	}
+
+	sortMatches(matches, order, func(id int) ([]int64, int64) {
+		return commentSortValues(r.comments[id], order), r.comments[id].Time
+	})
+
+	total := len(matches)
+	matches = matchesAfter(matches, cursor, order)
+	from, to := memOffsetAndLimit(len(matches), offset, limit)
+	items := make([]*HabrComment, 0, to-from)
+	for _, m := range matches[from:to] {
+		c := *r.comments[m.id]
+		c.Text = memSnippet(c.Text, terms)
+		items = append(items, &c)
+	}
+
+	return items, total, nil
+}
+
+func (r *MemoryRepo) SearchCode(text string, lang string, offset, limit int) ([]*HabrCode, int, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	if !r.ready {
+		return nil, 0, ErrNotReady
+	}
+
+	tokens := codeQueryTokens(text)
+	if len(tokens) == 0 {
+		return []*HabrCode{}, 0, nil
+	}
+
+	matches := make([]memMatch, 0)
+	for id, c := range r.code {
+		if len(lang) != 0 && c.Lang != lang {
+			continue
+		}
+		counts := make(map[string]int)
+		for _, token := range strings.Fields(c.Tokens) {
+			counts[token]++
+		}
+		rank := 0.0
+		for _, token := range tokens {
+			if counts[token] == 0 {
+				rank = 0
+				break
+			}
+			rank += float64(counts[token])
+		}
+		if rank > 0 {
+			matches = append(matches, memMatch{id: id, rank: rank})
+		}
+	}
+
+	sortMatches(matches, defaultSearchOrder, func(id int) ([]int64, int64) {
+		return make([]int64, len(defaultSearchOrder)), 0
+	})
+
+	from, to := memOffsetAndLimit(len(matches), offset, limit)
+	items := make([]*HabrCode, 0, to-from)
+	for _, m := range matches[from:to] {
+		c := *r.code[m.id]
+		items = append(items, &c)
+	}
+
+	return items, len(matches), nil
+}
+
+func (r *MemoryRepo) GetUsers(nicks []string, offset, limit int, cursor *Cursor, order SortOrder) ([]*HabrUser, int, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	if !r.ready {
+		return nil, 0, ErrNotReady
+	}
+
+	matches := make([]memMatch, 0)
+	for id, u := range r.users {
+		if len(nicks) == 0 || containsString(nicks, u.Nick) {
+			matches = append(matches, memMatch{id: id})
+		}
+	}
+
+	sortMatches(matches, order, func(id int) ([]int64, int64) {
+		return userSortValues(r.users[id], order), 0
+	})
+	total := len(matches)
+	matches = matchesAfter(matches, cursor, order)
+
+	from, to := memOffsetAndLimit(len(matches), offset, limit)
+	items := make([]*HabrUser, 0, to-from)
+	for _, m := range matches[from:to] {
+		u := *r.users[m.id]
+		items = append(items, &u)
+	}
+
+	return items, total, nil
+}
+
+func (r *MemoryRepo) GetUser(nick string) (*HabrUser, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	if !r.ready {
+		return nil, ErrNotReady
+	}
+
+	for _, u := range r.users {
+		if u.Nick == nick {
+			user := *u
+			return &user, nil
+		}
+	}
+	return nil, NotFoundError("User %s not found", nick)
+}
+
+func (r *MemoryRepo) UpsertUsers(users []*HabrUser) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.users == nil {
+		return fmt.Errorf("repo is not initialized")
+	}
+
+	ids := make(map[string]int, len(r.users))
+	maxID := 0
+	for id, u := range r.users {
+		ids[u.Nick] = id
+		if id > maxID {
+			maxID = id
+		}
+	}
+
+	for _, user := range users {
+		u := *user
+		if id, ok := ids[u.Nick]; ok {
+			u.ID = id
+		} else {
+			maxID++
+			u.ID = maxID
+			ids[u.Nick] = u.ID
+		}
+		r.users[u.ID] = &u
+	}
+	return nil
+}
+
+func (r *MemoryRepo) DeleteUsers(nicks []string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for id, u := range r.users {
+		if containsString(nicks, u.Nick) {
+			delete(r.users, id)
+		}
+	}
+	return nil
+}
+
+func (r *MemoryRepo) GetUsersPosts(nicks []string) ([]*HabrPost, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	if !r.ready {
+		return nil, ErrNotReady
+	}
+
+	users := make(map[string]bool, len(nicks))
+	for _, nick := range nicks {
+		users[nick] = true
+	}
+	ids := make(map[int]bool)
+	for _, p := range r.posts {
+		if users[p.User] {
+			ids[p.ID] = true
+		}
+	}
+	for _, c := range r.comments {
+		if users[c.User] {
+			ids[c.PostID] = true
+		}
+	}
+
+	posts := make([]*HabrPost, 0, len(ids))
+	for id := range ids {
+		if p, ok := r.posts[id]; ok {
+			post := *p
+			post.Comments = r.postComments(id)
+			posts = append(posts, &post)
+		}
+	}
+	return posts, nil
+}
+
+func (r *MemoryRepo) GetPost(id int, withComments bool) (*HabrPost, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	if !r.ready {
+		return nil, ErrNotReady
+	}
+
+	p, ok := r.posts[id]
+	if !ok {
+		return nil, NotFoundError("Post %d not found", id)
+	}
+
+	post := *p
+	if withComments {
+		post.Comments = r.postComments(id)
+	}
+	return &post, nil
+}
+
+func (r *MemoryRepo) GetPosts(filter PostsFilter, facets []string, offset int, limit int, cursor *Cursor, order SortOrder, withComments bool) ([]*HabrPost, Facets, int, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	if !r.ready {
+		return nil, nil, 0, ErrNotReady
+	}
+
+	found := make([]*HabrPost, 0)
+	matches := make([]memMatch, 0)
+	for id, p := range r.posts {
+		if matchPostsFilter(p, filter) {
+			found = append(found, p)
+			matches = append(matches, memMatch{id: id})
+		}
+	}
+
+	sortMatches(matches, order, func(id int) ([]int64, int64) {
+		return postSortValues(r.posts[id], order), r.posts[id].Time
+	})
+	matches = matchesAfter(matches, cursor, order)
+
+	from, to := memOffsetAndLimit(len(matches), offset, limit)
+	items := make([]*HabrPost, 0, to-from)
+	for _, m := range matches[from:to] {
+		p := r.posts[m.id]
+		post := *p
+		if withComments {
+			post.Comments = r.postComments(p.ID)
+		}
+		items = append(items, &post)
+	}
+
+	return items, memFacets(found, facets), len(found), nil
+}
+
+func (r *MemoryRepo) GetComments(postID int) ([]*HabrComment, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	if !r.ready {
+		return nil, ErrNotReady
+	}
+
+	return r.postComments(postID), nil
+}
+
+func (r *MemoryRepo) Stats() (RepoStats, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	stats := RepoStats{Ready: r.ready, Posts: len(r.posts), Comments: len(r.comments), Code: len(r.code), Users: len(r.users)}
+	for _, p := range r.posts {
+		if p.Time > stats.LastPostTime {
+			stats.LastPostTime = p.Time
+		}
+	}
+	return stats, nil
+}
+
+func (r *MemoryRepo) MaxPostID() (int, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	if !r.ready {
+		return 0, ErrNotReady
+	}
+	if len(r.posts) == 0 {
+		return 0, NotFoundError("Posts not found")
+	}
+
+	maxID := 0
+	for id := range r.posts {
+		if id > maxID {
+			maxID = id
+		}
+	}
+	return maxID, nil
+}
+
+func (r *MemoryRepo) UpsertPost(post *HabrPost) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.posts == nil {
+		return fmt.Errorf("repo is not initialized")
+	}
+
+	for _, cid := range r.byPost[post.ID] {
+		delete(r.comments, cid)
+	}
+	ids := make([]int, 0, len(post.Comments))
+	for _, comment := range post.Comments {
+		c := *comment
+		c.PostID = post.ID
+		r.comments[c.ID] = &c
+		ids = append(ids, c.ID)
+	}
+	r.byPost[post.ID] = ids
+
+	for _, id := range r.codeOf[post.ID] {
+		delete(r.code, id)
+	}
+	ids = make([]int, 0, len(post.Code))
+	for _, code := range post.Code {
+		c := *code
+		c.PostID = post.ID
+		c.Tokens = codeTokens(c.Code)
+		r.code[c.ID] = &c
+		ids = append(ids, c.ID)
+	}
+	r.codeOf[post.ID] = ids
+
+	item := *post
+	item.Comments = nil
+	item.Code = nil
+	r.posts[post.ID] = &item
+	return nil
+}
+
+func (r *MemoryRepo) RestoreAllFromFiles(path string) {
+	restoreAllFromFiles(r, path)
+}
+
+func (r *MemoryRepo) RestoreRangeFromFiles(path string, startID, finishID int) {
+	restoreRangeFromFiles(r, path, startID, finishID)
+}
+
+func (r *MemoryRepo) GetFTConfig(ns string) (FTConfig, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	cfg, err := r.cfg.ftConfig(ns)
+	if err != nil {
+		return FTConfig{}, err
+	}
+	return *cfg, nil
+}
+
+func (r *MemoryRepo) SetFTConfig(ns string, newCfg FTConfig) (FTConfig, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	cfg, err := r.cfg.ftConfig(ns)
+	if err != nil {
+		return FTConfig{}, err
+	}
+	prevCfg := *cfg
+	*cfg = newCfg
+	return prevCfg, saveRepoConfig(repoConfigPath(), r.cfg)
+}
+
+func (r *MemoryRepo) Init() {
+	r.lock.Lock()
+	if r.posts == nil {
+		r.posts = make(map[int]*HabrPost)
+		r.comments = make(map[int]*HabrComment)
+		r.byPost = make(map[int][]int)
+		r.code = make(map[int]*HabrCode)
+		r.codeOf = make(map[int][]int)
+		r.users = make(map[int]*HabrUser)
+	}
+	r.cfg = loadRepoConfig(repoConfigPath())
+	r.lock.Unlock()
+
+	if len(r.dumpPath) != 0 {
+		if _, err := ioutil.ReadDir(r.dumpPath); err != nil {
+			repoLog.Warnf("Can't load posts from %s: %s", r.dumpPath, err.Error())
+		} else {
+			r.RestoreAllFromFiles(r.dumpPath)
+		}
+	}
+	r.WarmUp()
+}
+
+func (r *MemoryRepo) WarmUp() {
+	r.lock.Lock()
+	r.ready = true
+	r.lock.Unlock()
+}
+
+// Done drops all data and config, so repo must be initialized again by Init
+func (r *MemoryRepo) Done() {
+	r.lock.Lock()
+	r.ready = false
+	r.posts, r.comments, r.byPost = nil, nil, nil
+	r.code, r.codeOf, r.users = nil, nil, nil
+	r.cfg = RepoConfig{}
+	r.lock.Unlock()
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestMemoryRepoDoneResetsState(t *testing.T) {
+	r := NewMemoryRepo("")
+	r.Init()
+	post := &HabrPost{ID: 1, User: "bob", Comments: []*HabrComment{{ID: 10, User: "alice"}}, Code: []*HabrCode{{ID: 100, Code: "fmt.Println()"}}}
+	if err := r.UpsertPost(post); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.UpsertUsers([]*HabrUser{{Nick: "bob", Posts: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	r.Done()
+
+	if r.posts != nil || r.comments != nil || r.byPost != nil || r.code != nil || r.codeOf != nil || r.users != nil {
+		t.Errorf("Maps are not dropped by Done")
+	}
+	if r.ready || r.cfg.Version != 0 {
+		t.Errorf("Repo is ready %v with config version %d after Done", r.ready, r.cfg.Version)
+	}
+}
+
+func TestMemoryRepoUsesFTConfigWeights(t *testing.T) {
+	dir, err := ioutil.TempDir("", "repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	prevDataDir := *dataDir
+	*dataDir = dir
+	defer func() { *dataDir = prevDataDir }()
+
+	r := NewMemoryRepo("")
+	r.Init()
+	defer r.Done()
+	for _, p := range []*HabrPost{
+		{ID: 1, Title: "golang", Text: "intro"},
+		{ID: 2, Title: "intro", Text: "golang and golang"},
+	} {
+		if err = r.UpsertPost(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	firstID := func() int {
+		items, _, _, err := r.SearchPosts("golang", NoPostsFilter, nil, -1, -1, nil, defaultSearchOrder)
+		if err != nil || len(items) != 2 {
+			t.Fatalf("SearchPosts returned %d items, error %v", len(items), err)
+		}
+		return items[0].ID
+	}
+	if id := firstID(); id != 1 {
+		t.Errorf("Post %d is the first with default weights, want post with title match", id)
+	}
+
+	cfg := defaultRepoConfig().PostsFt
+	cfg.Fields = "*^1.0,title^0.1"
+	if _, err = r.SetFTConfig("posts", cfg); err != nil {
+		t.Fatal(err)
+	}
+	if id := firstID(); id != 2 {
+		t.Errorf("Post %d is the first after title weight is decreased, want post with text matches", id)
+	}
+}
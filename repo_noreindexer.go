@@ -0,0 +1,10 @@
+//go:build noreindexer
+// +build noreindexer
+
+package main
+
+import "fmt"
+
+func newReindexerRepo(dsn string) (Storage, error) {
+	return nil, fmt.Errorf("binary is built without reindexer support, use '-storage memory'")
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// allowedTags are HTML tags, which are kept in sanitized post text, with their allowed attributes.
+// Children of other tags are kept without tag itself
+var allowedTags = map[string][]string{
+	"p": nil, "br": nil, "hr": nil, "div": nil, "span": nil,
+	"h1": nil, "h2": nil, "h3": nil, "h4": nil, "h5": nil, "h6": nil,
+	"b": nil, "strong": nil, "i": nil, "em": nil, "u": nil, "s": nil, "sup": nil, "sub": nil,
+	"blockquote": nil, "pre": nil, "code": {"class"},
+	"ul": nil, "ol": nil, "li": nil,
+	"table": nil, "thead": nil, "tbody": nil, "tr": nil, "th": nil, "td": nil,
+	"a":   {"href"},
+	"img": {"src", "alt"},
+}
+
+// droppedTags are removed from sanitized post text with all their content
+var droppedTags = map[string]bool{"script": true, "style": true, "iframe": true, "noscript": true, "object": true, "embed": true, "form": true}
+
+// sanitizeHTML returns inner HTML of selection with allowed tags and attributes only
+func sanitizeHTML(s *goquery.Selection) string {
+	buf := &bytes.Buffer{}
+	for _, n := range s.Nodes {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			sanitizeNode(buf, c)
+		}
+	}
+	return strings.TrimSpace(buf.String())
+}
+
+func sanitizeNode(buf *bytes.Buffer, n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		buf.WriteString(html.EscapeString(n.Data))
+		return
+	case html.ElementNode:
+	default:
+		return
+	}
+
+	if droppedTags[n.Data] {
+		return
+	}
+	attrs, allowed := allowedTags[n.Data]
+	if allowed {
+		buf.WriteString("<" + n.Data)
+		for _, a := range n.Attr {
+			if !containsString(attrs, a.Key) {
+				continue
+			}
+			if (a.Key == "href" || a.Key == "src") && !safeURL(a.Val) {
+				continue
+			}
+			fmt.Fprintf(buf, ` %s="%s"`, a.Key, html.EscapeString(a.Val))
+		}
+		buf.WriteString(">")
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		sanitizeNode(buf, c)
+	}
+	if allowed && n.Data != "br" && n.Data != "hr" && n.Data != "img" {
+		buf.WriteString("</" + n.Data + ">")
+	}
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// safeURL returns true for http(s) and relative URLs
+func safeURL(value string) bool {
+	u, err := url.Parse(strings.TrimSpace(value))
+	return err == nil && (u.Scheme == "" || u.Scheme == "http" || u.Scheme == "https")
+}
+
+var blankLinesRe = regexp.MustCompile(`\n{3,}`)
+
+// markdownEscaper escapes text, so HTML entities, decoded by parser, and markup characters are not
+// interpreted as Markdown or raw HTML
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`, "<", `\<`, ">", `\>`, "&", `\&`, "[", `\[`, "]", `\]`, "*", `\*`, "_", `\_`, "`", "\\`",
+)
+
+// markdownURLEscaper escapes URL of link or image, so it can't close link destination
+var markdownURLEscaper = strings.NewReplacer("(", `\(`, ")", `\)`, " ", "%20", "<", "%3C", ">", "%3E")
+
+var backticksRe = regexp.MustCompile("`+")
+
+// codeLangRe matches language of fenced code block
+var codeLangRe = regexp.MustCompile(`^[\w#+.-]+$`)
+
+// codeFence returns fence of backticks, which is longer than any backticks sequence in code
+func codeFence(code string, min int) string {
+	n := min
+	for _, ticks := range backticksRe.FindAllString(code, -1) {
+		if len(ticks) >= n {
+			n = len(ticks) + 1
+		}
+	}
+	return strings.Repeat("`", n)
+}
+
+// htmlToMarkdown converts sanitized post HTML to Markdown
+func htmlToMarkdown(text string) string {
+	nodes, err := html.ParseFragment(strings.NewReader(text), &html.Node{Type: html.ElementNode, Data: "div", DataAtom: atom.Div})
+	if err != nil {
+		return text
+	}
+	buf := &bytes.Buffer{}
+	for _, n := range nodes {
+		writeMarkdown(buf, n, "")
+	}
+	return strings.TrimSpace(blankLinesRe.ReplaceAllString(buf.String(), "\n\n")) + "\n"
+}
+
+func writeMarkdownChildren(buf *bytes.Buffer, n *html.Node, prefix string) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		writeMarkdown(buf, c, prefix)
+	}
+}
+
+// writeMarkdown writes node as Markdown. Prefix is written after each line break, it is used for quotes and lists
+func writeMarkdown(buf *bytes.Buffer, n *html.Node, prefix string) {
+	if n.Type == html.TextNode {
+		buf.WriteString(strings.Replace(markdownEscaper.Replace(n.Data), "\n", "\n"+prefix, -1))
+		return
+	}
+	if n.Type != html.ElementNode {
+		return
+	}
+
+	attr := func(key string) string {
+		for _, a := range n.Attr {
+			if a.Key == key {
+				return a.Val
+			}
+		}
+		return ""
+	}
+
+	switch n.Data {
+	case "br":
+		buf.WriteString("\n" + prefix)
+	case "hr":
+		buf.WriteString("\n" + prefix + "---\n" + prefix)
+	case "p", "div", "table":
+		buf.WriteString("\n" + prefix)
+		writeMarkdownChildren(buf, n, prefix)
+		buf.WriteString("\n" + prefix)
+	case "h1", "h2", "h3", "h4", "h5", "h6":
+		buf.WriteString("\n\n" + prefix + strings.Repeat("#", int(n.Data[1]-'0')) + " ")
+		writeMarkdownChildren(buf, n, prefix)
+		buf.WriteString("\n\n" + prefix)
+	case "b", "strong":
+		buf.WriteString("**")
+		writeMarkdownChildren(buf, n, prefix)
+		buf.WriteString("**")
+	case "i", "em":
+		buf.WriteString("*")
+		writeMarkdownChildren(buf, n, prefix)
+		buf.WriteString("*")
+	case "s":
+		buf.WriteString("~~")
+		writeMarkdownChildren(buf, n, prefix)
+		buf.WriteString("~~")
+	case "a":
+		if len(attr("href")) == 0 {
+			writeMarkdownChildren(buf, n, prefix)
+			break
+		}
+		buf.WriteString("[")
+		writeMarkdownChildren(buf, n, prefix)
+		buf.WriteString("](" + markdownURLEscaper.Replace(attr("href")) + ")")
+	case "img":
+		if len(attr("src")) != 0 {
+			buf.WriteString("![" + markdownEscaper.Replace(attr("alt")) + "](" + markdownURLEscaper.Replace(attr("src")) + ")")
+		}
+	case "code":
+		// Code span is literal, so it is not escaped, but delimited by fence longer than its backticks
+		code := strings.Replace(goquery.NewDocumentFromNode(n).Text(), "\n", " ", -1)
+		fence := codeFence(code, 1)
+		if strings.HasPrefix(code, "`") || strings.HasSuffix(code, "`") {
+			code = " " + code + " "
+		}
+		buf.WriteString(fence + code + fence)
+	case "pre":
+		code := goquery.NewDocumentFromNode(n).Text()
+		lang := ""
+		if c := n.FirstChild; c != nil && c.Type == html.ElementNode && c.Data == "code" {
+			for _, a := range c.Attr {
+				if classes := strings.Fields(a.Val); a.Key == "class" && len(classes) != 0 && codeLangRe.MatchString(classes[0]) {
+					lang = classes[0]
+				}
+			}
+		}
+		lines := strings.Split(strings.TrimRight(code, "\n"), "\n")
+		fence := codeFence(code, 3)
+		buf.WriteString("\n\n" + prefix + fence + lang + "\n" + prefix)
+		buf.WriteString(strings.Join(lines, "\n"+prefix))
+		buf.WriteString("\n" + prefix + fence + "\n\n" + prefix)
+	case "blockquote":
+		buf.WriteString("\n\n" + prefix + "> ")
+		writeMarkdownChildren(buf, n, prefix+"> ")
+		buf.WriteString("\n\n" + prefix)
+	case "ul", "ol":
+		buf.WriteString("\n" + prefix)
+		num := 0
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type != html.ElementNode || c.Data != "li" {
+				continue
+			}
+			num++
+			marker := "- "
+			if n.Data == "ol" {
+				marker = fmt.Sprintf("%d. ", num)
+			}
+			buf.WriteString("\n" + prefix + marker)
+			writeMarkdownChildren(buf, c, prefix+strings.Repeat(" ", len(marker)))
+		}
+		buf.WriteString("\n\n" + prefix)
+	case "tr":
+		buf.WriteString("\n" + prefix + "|")
+		cells, header := 0, false
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type == html.ElementNode {
+				buf.WriteString(" ")
+				writeMarkdownChildren(buf, c, prefix)
+				buf.WriteString(" |")
+				cells++
+				header = header || c.Data == "th"
+			}
+		}
+		if header {
+			buf.WriteString("\n" + prefix + "|" + strings.Repeat("---|", cells))
+		}
+	default:
+		writeMarkdownChildren(buf, n, prefix)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+func sanitizeString(t *testing.T, text string) string {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader("<div id=\"post\">" + text + "</div>"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sanitizeHTML(doc.Find("#post"))
+}
+
+func TestSanitizeHTML(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{`<p>Hello <b>world</b></p>`, `<p>Hello <b>world</b></p>`},
+		{`<script>alert(1)</script><p>text</p>`, `<p>text</p>`},
+		{`<img src="x" onerror="alert(1)">`, `<img src="x">`},
+		{`<a href="javascript:alert(1)">link</a>`, `<a>link</a>`},
+		{`<a href="https://habr.com/" target="_blank">link</a>`, `<a href="https://habr.com/">link</a>`},
+		{`<font color="red">text</font>`, `text`},
+		{`&lt;img src=x onerror=alert(1)&gt;`, `&lt;img src=x onerror=alert(1)&gt;`},
+	}
+	for _, tt := range tests {
+		if got := sanitizeString(t, tt.text); got != tt.want {
+			t.Errorf("sanitizeHTML(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestHTMLToMarkdown(t *testing.T) {
+	tests := []struct {
+		html string
+		want string
+	}{
+		{`<p>Hello <b>world</b></p>`, "Hello **world**\n"},
+		{`<h2>Title</h2><p>text</p>`, "## Title\n\ntext\n"},
+		{`<a href="https://habr.com/">habr</a>`, "[habr](https://habr.com/)\n"},
+		{`<a href="https://a.com/x)y">a</a>`, "[a](https://a.com/x\\)y)\n"},
+		{`<img src="https://a.com/i.png" alt="[pic]">`, "![\\[pic\\]](https://a.com/i.png)\n"},
+		{`<p>2 * 3_4 [x] \ &amp;</p>`, "2 \\* 3\\_4 \\[x\\] \\\\ \\&\n"},
+		{`<p><code>a_b*c</code></p>`, "`a_b*c`\n"},
+		{"<p><code>a`b</code></p>", "``a`b``\n"},
+		{`<pre><code class="go">x := "&lt;b&gt;"</code></pre>`, "```go\nx := \"<b>\"\n```\n"},
+		{"<pre><code>```\nx</code></pre>", "````\n```\nx\n````\n"},
+		{`<ul><li>one</li><li>two</li></ul>`, "- one\n- two\n"},
+	}
+	for _, tt := range tests {
+		if got := htmlToMarkdown(tt.html); got != tt.want {
+			t.Errorf("htmlToMarkdown(%q) = %q, want %q", tt.html, got, tt.want)
+		}
+	}
+}
+
+// Entities, decoded by HTML parser, must not become live HTML in Markdown
+func TestHTMLToMarkdownEscapesDecodedEntities(t *testing.T) {
+	payload := `&lt;img src=x onerror=alert(1)&gt;`
+	md := htmlToMarkdown(sanitizeString(t, payload))
+	if strings.Contains(strings.Replace(md, `\<`, "", -1), "<") {
+		t.Fatalf("htmlToMarkdown returned live HTML: %q", md)
+	}
+	if want := "\\<img src=x onerror=alert(1)\\>\n"; md != want {
+		t.Errorf("htmlToMarkdown(%q) = %q, want %q", payload, md, want)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// SortRelevance sorts results of full text search by rank
+	SortRelevance = "relevance"
+	// SortFresh sorts results of full text search by rank blended with recency:
+	// rank decreases by freshRankPerYear for each year since publication
+	SortFresh = "fresh"
+
+	freshRankPerYear = 10
+	secondsPerYear   = 365 * 24 * 3600
+)
+
+var (
+	postsSortFields     = []string{SortRelevance, SortFresh, "time", "likes", "views", "favorites"}
+	commentsSortFields  = []string{SortRelevance, SortFresh, "time", "likes"}
+	postsListSortFields = []string{"time", "likes", "views", "favorites"}
+
+	defaultSearchOrder = SortOrder{{Field: SortRelevance}}
+	defaultPostsOrder  = SortOrder{{Field: "time"}}
+)
+
+// SortKey is sort field and direction. Relevance keys always place the most relevant items first
+type SortKey struct {
+	Field string
+	Desc  bool
+}
+
+// SortOrder is list of sort keys. Items with equal keys are sorted by ID
+type SortOrder []SortKey
+
+// ParseSortOrder parses comma separated list of fields, e.g. "-likes,time". Field with '-' prefix is sorted
+// in descending order. Only given fields are allowed
+func ParseSortOrder(value string, fields []string) (SortOrder, error) {
+	order := make(SortOrder, 0)
+	seen := make(map[string]bool)
+	for _, f := range strings.Split(value, ",") {
+		key := SortKey{Field: strings.TrimSpace(f)}
+		if strings.HasPrefix(key.Field, "-") {
+			key.Field, key.Desc = key.Field[1:], true
+		}
+
+		valid := false
+		for _, field := range fields {
+			valid = valid || field == key.Field
+		}
+		switch {
+		case !valid:
+			return nil, InvalidArgumentError("Invalid sort field '%s'. Valid values are: %s", key.Field, strings.Join(fields, ", "))
+		case seen[key.Field]:
+			return nil, InvalidArgumentError("Sort field '%s' is repeated", key.Field)
+		case key.Desc && key.isRank():
+			return nil, InvalidArgumentError("Sort field '%s' can't be descending, the most relevant items are always first", key.Field)
+		}
+		seen[key.Field] = true
+		order = append(order, key)
+	}
+	return order, nil
+}
+
+func (k SortKey) isRank() bool {
+	return k.Field == SortRelevance || k.Field == SortFresh
+}
+
+func (o SortOrder) String() string {
+	keys := make([]string, 0, len(o))
+	for _, k := range o {
+		if k.Desc {
+			keys = append(keys, "-"+k.Field)
+		} else {
+			keys = append(keys, k.Field)
+		}
+	}
+	return strings.Join(keys, ",")
+}
+
+// ByRank returns true, if order depends on rank of full text search
+func (o SortOrder) ByRank() bool {
+	for _, k := range o {
+		if k.isRank() {
+			return true
+		}
+	}
+	return false
+}
+
+// freshRank blends rank of item, published at time t, with recency
+func freshRank(rank float64, t, now int64) float64 {
+	return rank - float64(now-t)*freshRankPerYear/secondsPerYear
+}
+
+// freshSortExpr is reindexer sort expression of freshRank
+func freshSortExpr(now int64) string {
+	return fmt.Sprintf("rank() + time / %d - %d", secondsPerYear/freshRankPerYear, now/(secondsPerYear/freshRankPerYear))
+}
+
+func postSortValue(p *HabrPost, field string) int64 {
+	switch field {
+	case "time":
+		return p.Time
+	case "likes":
+		return int64(p.Likes)
+	case "favorites":
+		return int64(p.Favorites)
+	case "views":
+		return int64(p.Views)
+	}
+	return 0
+}
+
+func commentSortValue(c *HabrComment, field string) int64 {
+	switch field {
+	case "time":
+		return c.Time
+	case "likes":
+		return int64(c.Likes)
+	}
+	return 0
+}
+
+func postSortValues(p *HabrPost, order SortOrder) []int64 {
+	values := make([]int64, len(order))
+	for i, k := range order {
+		values[i] = postSortValue(p, k.Field)
+	}
+	return values
+}
+
+func commentSortValues(c *HabrComment, order SortOrder) []int64 {
+	values := make([]int64, len(order))
+	for i, k := range order {
+		values[i] = commentSortValue(c, k.Field)
+	}
+	return values
+}
+
+// compareSortValues compares values of sort keys in order, and then ids. It returns negative value,
+// if item a is placed before item b
+func compareSortValues(order SortOrder, a []float64, aID int, b []float64, bID int) int {
+	for i, k := range order {
+		if a[i] == b[i] {
+			continue
+		}
+		if (a[i] < b[i]) != (k.Desc || k.isRank()) {
+			return -1
+		}
+		return 1
+	}
+	return aID - bID
+}
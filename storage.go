@@ -0,0 +1,436 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type HabrComment struct {
+	ID       int      `reindex:"id,,pk" json:"id"`
+	PostID   int      `reindex:"post_id,,dense" json:"post_id"`
+	ParentID int      `reindex:"parent_id,,dense" json:"parent_id,omitempty"`
+	Depth    int      `reindex:"depth,-,dense" json:"depth,omitempty"`
+	Text     string   `reindex:"text,-,dense"  json:"text"`
+	User     string   `reindex:"user,-,dense" json:"user"`
+	Time     int64    `reindex:"time,-,dense" json:"time"`
+	Likes    int      `reindex:"likes,-,dense" json:"likes,omitempty"`
+	_        struct{} `reindex:"text+user=search,text,composite"`
+}
+
+type HabrPost struct {
+	ID        int      `reindex:"id,tree,pk" json:"id"`
+	Time      int64    `reindex:"time,tree,dense"  json:"time"`
+	Text      string   `reindex:"text,-"  json:"text"`
+	Title     string   `reindex:"title,-"  json:"title"`
+	User      string   `reindex:"user" json:"user"`
+	Hubs      []string `reindex:"hubs" json:"hubs"`
+	Tags      []string `reindex:"tags" json:"tags"`
+	Likes     int      `reindex:"likes,-,dense" json:"likes,omitempty"`
+	Favorites int      `reindex:"favorites,-,dense" json:"favorites,omitempty"`
+	Views     int      `reindex:"views,-,dense" json:"views"`
+	HasImage  bool     `json:"has_image,omitempty"`
+	// HTML is sanitized HTML of post text. It is not indexed and is returned only by GetPost
+	HTML string `json:"html,omitempty"`
+
+	Comments []*HabrComment `reindex:"comments,,joined" json:"comments,omitempty"`
+	Code     []*HabrCode    `reindex:"code,,joined" json:"code,omitempty"`
+	_        struct{}       `reindex:"title+text+user=search,text,composite"`
+}
+
+// HabrCode is code block of post. Tokens of identifiers are calculated by codeTokens on upsert
+// and are indexed instead of code
+type HabrCode struct {
+	ID     int    `reindex:"id,,pk" json:"id"`
+	PostID int    `reindex:"post_id,,dense" json:"post_id"`
+	Lang   string `reindex:"lang" json:"lang,omitempty"`
+	Code   string `json:"code"`
+	Tokens string `reindex:"tokens,text" json:"tokens,omitempty"`
+}
+
+type FTConfig struct {
+	Bm25Boost      float64 `json:"bm25_boost"`
+	Bm25Weight     float64 `json:"bm25_weight"`
+	DistanceBoost  float64 `json:"distance_boost"`
+	DistanceWeight float64 `json:"distance_weight"`
+	TermLenBoost   float64 `json:"term_len_boost"`
+	TermLenWeight  float64 `json:"term_len_weight"`
+	MinRelevancy   float64 `json:"min_relevancy"`
+	Fields         string  `json:"fields"`
+}
+
+// repoConfigVersion is current schema version of repo.cfg. Files without version are treated as version 1
+const repoConfigVersion = 1
+
+type RepoConfig struct {
+	Version    int      `json:"version"`
+	PostsFt    FTConfig `json:"posts"`
+	CommentsFt FTConfig `json:"comments"`
+}
+
+func defaultRepoConfig() RepoConfig {
+	return RepoConfig{
+		Version: repoConfigVersion,
+		PostsFt: FTConfig{
+			Bm25Boost:      0.1,
+			Bm25Weight:     0.3,
+			DistanceBoost:  2.0,
+			DistanceWeight: 0.5,
+			MinRelevancy:   0.2,
+			Fields:         "*^0.4,user^1.0,title^1.6",
+		},
+		CommentsFt: FTConfig{
+			Bm25Boost:      0.1,
+			Bm25Weight:     0.3,
+			DistanceBoost:  2.0,
+			DistanceWeight: 0.5,
+			MinRelevancy:   0.2,
+			Fields:         "",
+		},
+	}
+}
+
+func repoConfigPath() string {
+	return filepath.Join(*dataDir, "repo.cfg")
+}
+
+// Validate checks schema version and full text configs of all namespaces
+func (c RepoConfig) Validate() error {
+	if c.Version != repoConfigVersion {
+		return fmt.Errorf("Unsupported config version %d, expected %d", c.Version, repoConfigVersion)
+	}
+	if err := c.PostsFt.Validate("posts"); err != nil {
+		return err
+	}
+	return c.CommentsFt.Validate("comments")
+}
+
+// configDiff returns human readable differences between JSON representations of configs
+func configDiff(prefix string, from, to interface{}) []string {
+	var fromMap, toMap map[string]interface{}
+	fromData, _ := json.Marshal(from)
+	toData, _ := json.Marshal(to)
+	json.Unmarshal(fromData, &fromMap)
+	json.Unmarshal(toData, &toMap)
+
+	keys := make([]string, 0, len(toMap))
+	for key := range toMap {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	diff := make([]string, 0)
+	for _, key := range keys {
+		fromValue, toValue := fromMap[key], toMap[key]
+		if _, ok := toValue.(map[string]interface{}); ok {
+			diff = append(diff, configDiff(prefix+key+".", fromValue, toValue)...)
+		} else if !reflect.DeepEqual(fromValue, toValue) {
+			diff = append(diff, fmt.Sprintf("%s%s: %v -> %v", prefix, key, fromValue, toValue))
+		}
+	}
+	return diff
+}
+
+// loadRepoConfig reads repo config from path. Defaults are returned, if file does not exist or is invalid
+func loadRepoConfig(path string) RepoConfig {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			repoLog.Errorf("Error read repo config %s: %s, using defaults", path, err.Error())
+		}
+		return defaultRepoConfig()
+	}
+
+	cfg := RepoConfig{}
+	if err = json.Unmarshal(data, &cfg); err != nil {
+		repoLog.Errorf("Error parse repo config %s: %s, using defaults", path, err.Error())
+		return defaultRepoConfig()
+	}
+	if cfg.Version == 0 {
+		cfg.Version = 1
+	}
+	if err = cfg.Validate(); err != nil {
+		repoLog.Warnf("Invalid repo config %s: %s, using defaults", path, err.Error())
+		return defaultRepoConfig()
+	}
+
+	if diff := configDiff("", defaultRepoConfig(), cfg); len(diff) != 0 {
+		repoLog.Infof("Repo config %s differs from defaults: %s", path, strings.Join(diff, ", "))
+	} else {
+		repoLog.Infof("Repo config %s is equal to defaults", path)
+	}
+	return cfg
+}
+
+// saveRepoConfig atomically writes repo config to path
+func saveRepoConfig(path string, cfg RepoConfig) error {
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// writeFileAtomic writes data to temp file and renames it to path, so readers never see partially written file
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// ftConfig returns full text config of namespace
+func (c *RepoConfig) ftConfig(ns string) (*FTConfig, error) {
+	switch ns {
+	case "posts":
+		return &c.PostsFt, nil
+	case "comments":
+		return &c.CommentsFt, nil
+	default:
+		return nil, NotFoundError("Unknown namespace %s", ns)
+	}
+}
+
+func checkRange(name string, value, min, max float64) error {
+	if value < min || value > max {
+		return fmt.Errorf("%s must be in range [%g, %g], got %g", name, min, max, value)
+	}
+	return nil
+}
+
+// Validate checks, that config values are in ranges, accepted by reindexer, and fields exist in namespace.
+// fields is comma separated list of field[^boost], where field is '*' or one of namespace fields
+func (c FTConfig) Validate(ns string) error {
+	var nsFields []string
+	switch ns {
+	case "posts":
+		nsFields = postsQueryFields
+	case "comments":
+		nsFields = commentsQueryFields
+	default:
+		return fmt.Errorf("Unknown namespace %s", ns)
+	}
+
+	for _, err := range []error{
+		checkRange("bm25_boost", c.Bm25Boost, 0, 10),
+		checkRange("bm25_weight", c.Bm25Weight, 0, 1),
+		checkRange("distance_boost", c.DistanceBoost, 0, 10),
+		checkRange("distance_weight", c.DistanceWeight, 0, 1),
+		checkRange("term_len_boost", c.TermLenBoost, 0, 10),
+		checkRange("term_len_weight", c.TermLenWeight, 0, 1),
+		checkRange("min_relevancy", c.MinRelevancy, 0, 1),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(c.Fields) == 0 {
+		return nil
+	}
+	for _, field := range strings.Split(c.Fields, ",") {
+		parts := strings.SplitN(field, "^", 2)
+		name := strings.TrimSpace(parts[0])
+		known := name == "*"
+		for _, f := range nsFields {
+			known = known || f == name
+		}
+		if !known {
+			return fmt.Errorf("Unknown field '%s' in fields of namespace %s", name, ns)
+		}
+		if len(parts) == 2 {
+			boost, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+			if err != nil {
+				return fmt.Errorf("Invalid boost of field '%s': %s", name, parts[1])
+			}
+			if err = checkRange("boost of field "+name, boost, 0, 10); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// PostsFilter is set of conditions on posts fields. Posts matching any of Hubs and any of Tags are found.
+// Empty strings and slices, and -1 values are not applied
+type PostsFilter struct {
+	Hubs      []string
+	Tags      []string
+	User      string
+	StartTime int
+	EndTime   int
+	MinLikes  int
+	MinViews  int
+}
+
+// NoPostsFilter matches all posts
+var NoPostsFilter = PostsFilter{StartTime: -1, EndTime: -1, MinLikes: -1, MinViews: -1}
+
+// FacetValue is number of found posts with field value
+type FacetValue struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+var repoLog = logger.With(LogFields{"component": "repo"})
+
+// RepoStats is storage state, number of items in namespaces and publication time of the latest post
+type RepoStats struct {
+	Ready        bool
+	Posts        int
+	Comments     int
+	Code         int
+	Users        int
+	LastPostTime int64
+}
+
+// Facets are the most frequent values of fields over all found posts, by field name
+type Facets map[string][]FacetValue
+
+// maxFacetValues limits number of values returned for each facet field
+const maxFacetValues = 20
+
+// facetFields are posts fields, which are available for facets
+var facetFields = []string{"hubs", "tags", "user"}
+
+// Storage is the backend interface used by HTTP API, sync and load commands
+type Storage interface {
+	Init()
+	WarmUp()
+	Done()
+
+	// Search and list methods return items after cursor, if it is not nil. Total count is not calculated
+	// for such requests, because it is expensive on deep pages
+	SearchPosts(text string, filter PostsFilter, facets []string, offset, limit int, cursor *Cursor, order SortOrder) ([]*HabrPost, Facets, int, error)
+	SearchComments(text string, offset, limit int, cursor *Cursor, order SortOrder) ([]*HabrComment, int, error)
+	// SearchCode searches code blocks by identifiers, lang filters blocks by language, if it is not empty
+	SearchCode(text string, lang string, offset, limit int) ([]*HabrCode, int, error)
+	GetPost(id int, withComments bool) (*HabrPost, error)
+	GetPosts(filter PostsFilter, facets []string, offset int, limit int, cursor *Cursor, order SortOrder, withComments bool) ([]*HabrPost, Facets, int, error)
+	GetComments(postID int) ([]*HabrComment, error)
+	MaxPostID() (int, error)
+	Stats() (RepoStats, error)
+
+	// GetUsers returns profiles of users with given nicks, or of all users if nicks are empty
+	GetUsers(nicks []string, offset, limit int, cursor *Cursor, order SortOrder) ([]*HabrUser, int, error)
+	GetUser(nick string) (*HabrUser, error)
+
+	UpsertPost(post *HabrPost) error
+	// UpsertUsers adds or replaces users by nick. Replaced users keep their IDs, added users get IDs greater than existing
+	UpsertUsers(users []*HabrUser) error
+	DeleteUsers(nicks []string) error
+	// GetUsersPosts returns posts with comments, which are written or commented by users with given nicks
+	GetUsersPosts(nicks []string) ([]*HabrPost, error)
+	RestoreAllFromFiles(path string)
+	RestoreRangeFromFiles(path string, startID, finishID int)
+
+	GetFTConfig(ns string) (FTConfig, error)
+	// SetFTConfig applies full text config to namespace and returns previous one
+	SetFTConfig(ns string, newCfg FTConfig) (FTConfig, error)
+}
+
+func newStorage(kind string) (Storage, error) {
+	switch kind {
+	case "reindexer":
+		return newReindexerRepo(*reindexerDSN)
+	case "memory":
+		return NewMemoryRepo(*dumpPostsPath), nil
+	default:
+		return nil, fmt.Errorf("Unknown storage %s. Valid values are: 'reindexer' or 'memory'", kind)
+	}
+}
+
+func readPostFile(filePath string) (*HabrPost, error) {
+	jsonItem, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	post := &HabrPost{}
+	if err = json.Unmarshal(jsonItem, post); err != nil {
+		return nil, err
+	}
+	return post, nil
+}
+
+// updatePostFromFile upserts post from file and returns it, or nil if file can't be read
+func updatePostFromFile(s Storage, filePath string) *HabrPost {
+	post, err := readPostFile(filePath)
+	if err != nil {
+		repoLog.Errorf("Error read file %s: %s", filePath, err.Error())
+		return nil
+	}
+
+	if err = s.UpsertPost(post); err != nil {
+		repoLog.Errorf("Error upsert post from file %s: %s", filePath, err.Error())
+	}
+	return post
+}
+
+// restoreAllFromFiles upserts all posts from files and users, aggregated from them
+func restoreAllFromFiles(s Storage, path string) {
+	files, err := ioutil.ReadDir(path)
+	if err != nil {
+		repoLog.Fatalf("%s", err.Error())
+	}
+
+	users := newUsersAggregator()
+	for i, f := range files {
+		if post := updatePostFromFile(s, path+"/"+f.Name()); post != nil {
+			users.addPost(post)
+		}
+		if (i != 0 && (i%1000) == 0) || i == len(files)-1 {
+			repoLog.Infof("processed %d files (from %d)", i+1, len(files))
+		}
+	}
+
+	if err = s.UpsertUsers(users.Users()); err != nil {
+		repoLog.Errorf("Error upsert users: %s", err.Error())
+	}
+}
+
+func restoreIDsFromFiles(s Storage, path string, ids []int) {
+	cnt := 0
+	for _, id := range ids {
+		fileName := fmt.Sprintf("%s/%d.json", path, id)
+		if _, err := os.Stat(fileName); err == nil {
+			updatePostFromFile(s, fileName)
+			cnt++
+		}
+	}
+	repoLog.Infof("processed %d files", cnt)
+}
+
+func restoreRangeFromFiles(s Storage, path string, startID, finishID int) {
+	cnt := 0
+	for id := startID; id < finishID; id++ {
+		fileName := fmt.Sprintf("%s/%d.json", path, id)
+		if _, err := os.Stat(fileName); err == nil {
+			updatePostFromFile(s, fileName)
+			cnt++
+		}
+	}
+	repoLog.Infof("processed %d files", cnt+1)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"sync"
+	"time"
+)
+
+var syncLog = logger.With(LogFields{"component": "sync"})
+
+// maxRefreshPosts limits number of recently published posts, which are refreshed on each sync
+const maxRefreshPosts = 2000
+
+// SyncStatus describes data syncs. It is published to expvar as "sync"
+type SyncStatus struct {
+	Running        bool  `json:"running"`
+	Runs           int   `json:"runs"`
+	LastStarted    int64 `json:"last_started,omitempty"`
+	LastFinished   int64 `json:"last_finished,omitempty"`
+	LastDurationMs int64 `json:"last_duration_ms"`
+	LastUpdated    int   `json:"last_updated"`
+	LastFailed     int   `json:"last_failed"`
+}
+
+var syncStatus struct {
+	sync.Mutex
+	SyncStatus
+}
+
+func init() {
+	expvar.Publish("sync", expvar.Func(func() interface{} { return getSyncStatus() }))
+}
+
+func getSyncStatus() SyncStatus {
+	syncStatus.Lock()
+	defer syncStatus.Unlock()
+	return syncStatus.SyncStatus
+}
+
+// countResults returns number of downloaded posts and number of failures. Not existing posts are not failures
+func countResults(results []importResult) (updated, failed int) {
+	for _, res := range results {
+		switch {
+		case res.err == nil:
+			updated++
+		case res.status != 404:
+			failed++
+		}
+	}
+	return updated, failed
+}
+
+// discoverNewPosts downloads posts after lastID until maxMisses consecutive IDs are not downloaded,
+// and returns the highest downloaded ID with download results. Failed downloads are counted as misses,
+// so discovery stops during site outage instead of probing IDs until sync is cancelled
+func discoverNewPosts(ctx context.Context, lastID, maxMisses int) (int, []importResult) {
+	next, misses := lastID+1, 0
+	all := make([]importResult, 0)
+
+	for misses < maxMisses && ctx.Err() == nil {
+		results := downloadFiles(ctx, idRange(next, next+*numParallelImports*4), nil)
+		all = append(all, results...)
+		for _, res := range results {
+			if res.err == nil {
+				lastID = res.id
+				misses = 0
+			} else {
+				misses++
+			}
+			if misses >= maxMisses {
+				break
+			}
+		}
+		next += len(results)
+	}
+	return lastID, all
+}
+
+// recentPostIDs returns IDs of posts, published after since. Their likes, views and comments are still changing
+func recentPostIDs(since time.Time) []int {
+	filter := NoPostsFilter
+	filter.StartTime = int(since.Unix())
+	posts, _, _, err := repo.GetPosts(filter, nil, -1, maxRefreshPosts, nil, defaultPostsOrder, false)
+	if err != nil {
+		syncLog.Warnf("Can't get recent posts: %s", err.Error())
+		return nil
+	}
+	ids := make([]int, 0, len(posts))
+	for _, post := range posts {
+		ids = append(ids, post.ID)
+	}
+	return ids
+}
+
+func syncDiscover(ctx context.Context) []importResult {
+	maxID, err := repo.MaxPostID()
+	if err != nil {
+		syncLog.Warnf("Can't get last post ID: %s, starting discovery from ID %d", err.Error(), *importStartID)
+		maxID = *importStartID - 1
+	}
+
+	refreshIDs := recentPostIDs(time.Now().AddDate(0, 0, -*refreshDays))
+	syncLog.Infof("Refreshing %d posts published during last %d days", len(refreshIDs), *refreshDays)
+	results := downloadFiles(ctx, refreshIDs, nil)
+
+	syncLog.Infof("Discovering new posts after ID %d", maxID)
+	lastID, discovered := discoverNewPosts(ctx, maxID, *discoverMaxMisses)
+	syncLog.Infof("Discovered posts from ID %d to %d", maxID+1, lastID)
+
+	if ctx.Err() != nil {
+		syncLog.Warnf("Sync is cancelled, namespaces are not updated")
+		return append(results, discovered...)
+	}
+	results = append(results, discovered...)
+	restoreSynced(results, func() {
+		restoreIDsFromFiles(repo, *dumpPostsPath, refreshIDs)
+		repo.RestoreRangeFromFiles(*dumpPostsPath, maxID+1, lastID+1)
+	})
+	return results
+}
+
+func syncRange(ctx context.Context) []importResult {
+	syncLog.Infof("Downloading posts from ID %d to %d", *importStartID, *importFinishID)
+	results := downloadFiles(ctx, idRange(*importStartID, *importFinishID), nil)
+	if ctx.Err() != nil {
+		syncLog.Warnf("Sync is cancelled, namespaces are not updated")
+		return results
+	}
+	syncLog.Infof("Updating posts from ID %d to %d", *importStartID, *importFinishID)
+	restoreSynced(results, func() {
+		repo.RestoreRangeFromFiles(*dumpPostsPath, *importStartID, *importFinishID)
+	})
+	return results
+}
+
+// restoreSynced updates live namespaces from files with restore and aggregates again profiles of users,
+// who wrote or commented downloaded posts before or after update. Profiles of other users are not changed
+func restoreSynced(results []importResult, restore func()) {
+	ids := make([]int, 0, len(results))
+	for _, res := range results {
+		if res.err == nil {
+			ids = append(ids, res.id)
+		}
+	}
+
+	nicks := make(map[string]bool)
+	if err := postsUsers(repo, ids, nicks); err != nil {
+		syncLog.Errorf("Error get users of posts: %s", err.Error())
+	}
+	restore()
+	if err := postsUsers(repo, ids, nicks); err != nil {
+		syncLog.Errorf("Error get users of posts: %s", err.Error())
+	}
+	if err := updateUsers(repo, nicks); err != nil {
+		syncLog.Errorf("Error update users: %s", err.Error())
+	}
+	syncLog.Infof("Profiles of %d users are updated", len(nicks))
+}
+
+// syncData updates live namespaces in place, so API stays available during sync
+func syncData(ctx context.Context) {
+	t := time.Now()
+	syncStatus.Lock()
+	syncStatus.Running = true
+	syncStatus.LastStarted = t.Unix()
+	syncStatus.Unlock()
+
+	var results []importResult
+	switch *syncMode {
+	case "range":
+		results = syncRange(ctx)
+	default:
+		results = syncDiscover(ctx)
+	}
+	// Rebuild full text indexes now, instead of on the first search request
+	repo.WarmUp()
+
+	updated, failed := countResults(results)
+	elapsed := time.Now().Sub(t)
+
+	syncStatus.Lock()
+	syncStatus.Running = false
+	syncStatus.Runs++
+	syncStatus.LastFinished = time.Now().Unix()
+	syncStatus.LastDurationMs = int64(elapsed / time.Millisecond)
+	syncStatus.LastUpdated = updated
+	syncStatus.LastFailed = failed
+	syncStatus.Unlock()
+
+	syncLog.Infof("Sync done in %v: %d posts updated in live namespaces, %d failed", elapsed, updated, failed)
+}
+
+// syncDataRoutine periodically syncs data until context is cancelled
+func syncDataRoutine(ctx context.Context) {
+	for {
+		if sleepContext(ctx, time.Duration(*syncTimeout)*time.Minute) != nil {
+			return
+		}
+		syncLog.Infof("Syncing...")
+		syncData(ctx)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"sort"
+)
+
+// maxTopHubs limits number of hubs in user profile
+const maxTopHubs = 5
+
+// HabrUser is profile of author, aggregated from posts and comments. ID is assigned by storage, when user is added,
+// and is kept on updates of profile. It is used as tie breaker of sorting
+type HabrUser struct {
+	ID       int    `reindex:"id,,pk" json:"id"`
+	Nick     string `reindex:"nick,hash" json:"nick"`
+	Posts    int    `reindex:"posts,-,dense" json:"posts"`
+	Comments int    `reindex:"comments,-,dense" json:"comments"`
+	// Likes are total likes of posts and comments of user
+	Likes         int      `reindex:"likes,-,dense" json:"likes"`
+	FirstActivity int64    `reindex:"first_activity,-,dense" json:"first_activity,omitempty"`
+	LastActivity  int64    `reindex:"last_activity,-,dense" json:"last_activity,omitempty"`
+	TopHubs       []string `json:"top_hubs,omitempty"`
+}
+
+var (
+	usersSortFields   = []string{"likes", "posts", "comments", "first_activity", "last_activity"}
+	defaultUsersOrder = SortOrder{{Field: "likes", Desc: true}}
+)
+
+func userSortValue(u *HabrUser, field string) int64 {
+	switch field {
+	case "likes":
+		return int64(u.Likes)
+	case "posts":
+		return int64(u.Posts)
+	case "comments":
+		return int64(u.Comments)
+	case "first_activity":
+		return u.FirstActivity
+	case "last_activity":
+		return u.LastActivity
+	}
+	return 0
+}
+
+func userSortValues(u *HabrUser, order SortOrder) []int64 {
+	values := make([]int64, len(order))
+	for i, k := range order {
+		values[i] = userSortValue(u, k.Field)
+	}
+	return values
+}
+
+func nextUsersCursor(items []*HabrUser, offset, limit int, order SortOrder) *Cursor {
+	return nextCursor(len(items), offset, limit, order, func() ([]int64, int) {
+		last := items[len(items)-1]
+		return userSortValues(last, order), last.ID
+	})
+}
+
+// usersAggregator collects profiles of users from posts and their comments.
+// Hubs of post are counted for its author and for each commenter
+type usersAggregator struct {
+	users map[string]*HabrUser
+	hubs  map[string]map[string]int
+	// only limits aggregation to users with these nicks, if it is not nil
+	only map[string]bool
+}
+
+func newUsersAggregator() *usersAggregator {
+	return &usersAggregator{users: make(map[string]*HabrUser), hubs: make(map[string]map[string]int)}
+}
+
+// activity returns profile of user to update its counters, or nil if user is not aggregated
+func (a *usersAggregator) activity(nick string, t int64, likes int, hubs []string) *HabrUser {
+	if len(nick) == 0 || (a.only != nil && !a.only[nick]) {
+		return nil
+	}
+	u, ok := a.users[nick]
+	if !ok {
+		u = &HabrUser{Nick: nick}
+		a.users[nick] = u
+		a.hubs[nick] = make(map[string]int)
+	}
+	u.Likes += likes
+	if t != 0 && (u.FirstActivity == 0 || t < u.FirstActivity) {
+		u.FirstActivity = t
+	}
+	if t > u.LastActivity {
+		u.LastActivity = t
+	}
+	for _, hub := range hubs {
+		a.hubs[nick][hub]++
+	}
+	return u
+}
+
+func (a *usersAggregator) addPost(post *HabrPost) {
+	if u := a.activity(post.User, post.Time, post.Likes, post.Hubs); u != nil {
+		u.Posts++
+	}
+	for _, c := range post.Comments {
+		if u := a.activity(c.User, c.Time, c.Likes, post.Hubs); u != nil {
+			u.Comments++
+		}
+	}
+}
+
+// postsUsers adds nicks of authors and commenters of stored posts with given IDs to nicks. Not stored posts are skipped
+func postsUsers(s Storage, ids []int, nicks map[string]bool) error {
+	for _, id := range ids {
+		post, err := s.GetPost(id, true)
+		if apiErr, ok := err.(*APIError); ok && apiErr.Code == CodeNotFound {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if len(post.User) != 0 {
+			nicks[post.User] = true
+		}
+		for _, c := range post.Comments {
+			if len(c.User) != 0 {
+				nicks[c.User] = true
+			}
+		}
+	}
+	return nil
+}
+
+// updateUsers aggregates again profiles of users with given nicks from their posts and comments.
+// Users, which have no posts and comments anymore, are deleted
+func updateUsers(s Storage, nicks map[string]bool) error {
+	if len(nicks) == 0 {
+		return nil
+	}
+	list := make([]string, 0, len(nicks))
+	for nick := range nicks {
+		list = append(list, nick)
+	}
+	sort.Strings(list)
+
+	posts, err := s.GetUsersPosts(list)
+	if err != nil {
+		return err
+	}
+	users := newUsersAggregator()
+	users.only = nicks
+	for _, post := range posts {
+		users.addPost(post)
+	}
+
+	deleted := make([]string, 0)
+	for _, nick := range list {
+		if _, ok := users.users[nick]; !ok {
+			deleted = append(deleted, nick)
+		}
+	}
+	if err = s.UpsertUsers(users.Users()); err != nil {
+		return err
+	}
+	return s.DeleteUsers(deleted)
+}
+
+// Users returns aggregated profiles sorted by nick. IDs are not set, they are assigned by storage
+func (a *usersAggregator) Users() []*HabrUser {
+	users := make([]*HabrUser, 0, len(a.users))
+	for _, u := range a.users {
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Nick < users[j].Nick })
+
+	for _, u := range users {
+		hubs := a.hubs[u.Nick]
+		u.TopHubs = make([]string, 0, len(hubs))
+		for hub := range hubs {
+			u.TopHubs = append(u.TopHubs, hub)
+		}
+		sort.Slice(u.TopHubs, func(i, j int) bool {
+			ci, cj := hubs[u.TopHubs[i]], hubs[u.TopHubs[j]]
+			if ci == cj {
+				return u.TopHubs[i] < u.TopHubs[j]
+			}
+			return ci > cj
+		})
+		if len(u.TopHubs) > maxTopHubs {
+			u.TopHubs = u.TopHubs[:maxTopHubs]
+		}
+	}
+	return users
+}
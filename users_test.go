@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestUpdateUsersKeepsIDs(t *testing.T) {
+	r := NewMemoryRepo("")
+	r.Init()
+	defer r.Done()
+
+	posts := []*HabrPost{
+		{ID: 1, User: "bob", Time: 100, Likes: 5, Hubs: []string{"go"}, Comments: []*HabrComment{{ID: 10, User: "alice", Time: 110, Likes: 1}}},
+		{ID: 2, User: "carol", Time: 200, Likes: 3, Hubs: []string{"rust"}, Comments: []*HabrComment{{ID: 20, User: "alice", Time: 210}}},
+	}
+	for _, p := range posts {
+		if err := r.UpsertPost(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	all := map[string]bool{"alice": true, "bob": true, "carol": true}
+	if err := updateUsers(r, all); err != nil {
+		t.Fatal(err)
+	}
+	ids := make(map[string]int)
+	for nick := range all {
+		u, err := r.GetUser(nick)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[nick] = u.ID
+	}
+
+	// Comment of alice is removed and post of new user dave is added
+	posts[1].Comments = nil
+	posts = append(posts, &HabrPost{ID: 3, User: "dave", Time: 300})
+	for _, p := range posts[1:] {
+		if err := r.UpsertPost(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := updateUsers(r, map[string]bool{"alice": true, "carol": true, "dave": true, "eve": true}); err != nil {
+		t.Fatal(err)
+	}
+
+	for nick, id := range ids {
+		u, err := r.GetUser(nick)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.ID != id {
+			t.Errorf("ID of %s is changed from %d to %d", nick, id, u.ID)
+		}
+	}
+	alice, _ := r.GetUser("alice")
+	if alice.Comments != 1 || alice.Likes != 1 || alice.LastActivity != 110 {
+		t.Errorf("alice is %+v, want 1 comment with 1 like at 110", alice)
+	}
+	dave, err := r.GetUser("dave")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range ids {
+		if dave.ID == id {
+			t.Errorf("New user dave got ID %d of existing user", id)
+		}
+	}
+	if _, err = r.GetUser("eve"); err == nil {
+		t.Errorf("User eve without posts and comments is stored")
+	}
+}